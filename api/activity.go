@@ -0,0 +1,331 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/goji/web"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// listByIssue loads all rows of a table belonging to an issue, oldest first.
+func listByIssue(table, issueID string, result interface{}) error {
+	cursor, err := r.DB(*rethinkdbDatabase).Table(table).GetAllByIndex("issue_id", issueID).OrderBy("date").Run(session)
+	if err != nil {
+		return err
+	}
+
+	return cursor.All(result)
+}
+
+// deleteByIssue removes a row of a table, making sure it belongs to the issue.
+func deleteByIssue(table, issueID, id string) (bool, error) {
+	resp, err := r.DB(*rethinkdbDatabase).Table(table).GetAllByIndex("issue_id", issueID).Filter(map[string]interface{}{
+		"id": id,
+	}).Delete().RunWrite(session)
+	if err != nil {
+		return false, err
+	}
+
+	return resp.Deleted > 0, nil
+}
+
+// GET /issues/:id/activity - chronological feed of the issue's history
+func listActivity(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	result := []*models.Activity{}
+	if err := listByIssue("activities", issue.ID, &result); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// POST /issues/:id/assign - {"actor": "", "assignee": ""}, an empty assignee
+// unassigns the issue
+func assignIssue(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor    string `json:"actor"`
+		Assignee string `json:"assignee"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// recordIssue replaces whole issues
+	defer lockIssues(c.URLParams["id"])()
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	activity := &models.Activity{
+		Type:  models.ActivityAssigned,
+		Actor: input.Actor,
+		Data: map[string]interface{}{
+			"assignee": input.Assignee,
+		},
+	}
+	if input.Assignee == "" {
+		activity.Type = models.ActivityUnassigned
+		activity.Data = map[string]interface{}{
+			"assignee": issue.AssignedTo,
+		}
+	}
+
+	issue.AssignedTo = input.Assignee
+
+	updateIssueStatus(w, issue, activity)
+}
+
+// GET /issues/:id/comments
+func listComments(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	result := []*models.Comment{}
+	if err := listByIssue("comments", issue.ID, &result); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// POST /issues/:id/comments - {"actor": "", "body": ""}
+func createComment(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor string `json:"actor"`
+		Body  string `json:"body"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if strings.TrimSpace(input.Body) == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("Empty comment"))
+		return
+	}
+	if input.Actor == "" {
+		input.Actor = "admin"
+	}
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	comment := &models.Comment{
+		ID:      uniuri.NewLen(uniuri.UUIDLen),
+		IssueID: issue.ID,
+		Author:  input.Actor,
+		Body:    input.Body,
+		Date:    time.Now(),
+	}
+	if err := r.DB(*rethinkdbDatabase).Table("comments").Insert(comment).Exec(session); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := insertActivity(&models.Activity{
+		IssueID: issue.ID,
+		Type:    models.ActivityCommented,
+		Actor:   input.Actor,
+		Date:    comment.Date,
+		Data: map[string]interface{}{
+			"comment_id": comment.ID,
+		},
+	}); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, comment)
+}
+
+// DELETE /issues/:id/comments/:comment
+func deleteComment(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	deleted, err := deleteByIssue("comments", c.URLParams["id"], c.URLParams["comment"])
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !deleted {
+		w.WriteHeader(404)
+		w.Write([]byte("Comment not found"))
+		return
+	}
+
+	if err := insertActivity(&models.Activity{
+		IssueID: c.URLParams["id"],
+		Type:    models.ActivityCommentDeleted,
+		Actor:   req.URL.Query().Get("actor"),
+		Data: map[string]interface{}{
+			"comment_id": c.URLParams["comment"],
+		},
+	}); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Write([]byte("Success"))
+}
+
+// GET /issues/:id/links
+func listLinks(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	result := []*models.Link{}
+	if err := listByIssue("links", issue.ID, &result); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// POST /issues/:id/links - {"actor": "", "url": "", "title": ""}
+func createLink(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor string `json:"actor"`
+		URL   string `json:"url"`
+		Title string `json:"title"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if u, err := url.Parse(input.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid URL"))
+		return
+	}
+	if input.Actor == "" {
+		input.Actor = "admin"
+	}
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	link := &models.Link{
+		ID:      uniuri.NewLen(uniuri.UUIDLen),
+		IssueID: issue.ID,
+		URL:     input.URL,
+		Title:   input.Title,
+		Author:  input.Actor,
+		Date:    time.Now(),
+	}
+	if err := r.DB(*rethinkdbDatabase).Table("links").Insert(link).Exec(session); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := insertActivity(&models.Activity{
+		IssueID: issue.ID,
+		Type:    models.ActivityLinked,
+		Actor:   input.Actor,
+		Date:    link.Date,
+		Data: map[string]interface{}{
+			"url": link.URL,
+		},
+	}); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, link)
+}
+
+// DELETE /issues/:id/links/:link
+func deleteLink(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	deleted, err := deleteByIssue("links", c.URLParams["id"], c.URLParams["link"])
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if !deleted {
+		w.WriteHeader(404)
+		w.Write([]byte("Link not found"))
+		return
+	}
+
+	if err := insertActivity(&models.Activity{
+		IssueID: c.URLParams["id"],
+		Type:    models.ActivityUnlinked,
+		Actor:   req.URL.Query().Get("actor"),
+		Data: map[string]interface{}{
+			"link_id": c.URLParams["link"],
+		},
+	}); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Write([]byte("Success"))
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Circuit breaker states
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+var errCircuitOpen = errors.New("Circuit breaker is open")
+
+// circuitBreaker stops deliveries to a destination after repeated failures.
+// Once the cooldown is over, a single delivery is let through to probe the
+// destination, closing the breaker if it succeeds.
+type circuitBreaker struct {
+	breakerStatus
+	lock sync.Mutex
+}
+
+type breakerStatus struct {
+	Name      string    `json:"name"`
+	State     string    `json:"state"`
+	Failures  int       `json:"failures"`
+	OpenedAt  time.Time `json:"opened_at"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+var (
+	breakers    = []*circuitBreaker{}
+	breakerLock sync.Mutex
+)
+
+// newCircuitBreaker creates a closed breaker, listed on the status endpoint.
+func newCircuitBreaker(name string) *circuitBreaker {
+	cb := &circuitBreaker{
+		breakerStatus: breakerStatus{
+			Name:  name,
+			State: breakerClosed,
+		},
+	}
+
+	breakerLock.Lock()
+	breakers = append(breakers, cb)
+	breakerLock.Unlock()
+
+	return cb
+}
+
+// Allow returns whether a delivery may be attempted.
+func (cb *circuitBreaker) Allow() bool {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	switch cb.State {
+	case breakerOpen:
+		if time.Since(cb.OpenedAt) < *breakerCooldown {
+			return false
+		}
+		cb.State = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// The probe is still running
+		return false
+	}
+
+	return true
+}
+
+// Record updates the breaker with the outcome of an allowed delivery.
+func (cb *circuitBreaker) Record(err error) {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	if err == nil {
+		cb.State = breakerClosed
+		cb.Failures = 0
+		return
+	}
+
+	cb.Failures++
+	cb.LastError = err.Error()
+	if cb.State == breakerHalfOpen || cb.Failures >= *breakerThreshold {
+		cb.State = breakerOpen
+		cb.OpenedAt = time.Now()
+	}
+}
+
+func (cb *circuitBreaker) status() breakerStatus {
+	cb.lock.Lock()
+	defer cb.lock.Unlock()
+
+	return cb.breakerStatus
+}
+
+// GET /status - state of the delivery destinations, the queue and the spool
+func showStatus(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	result := []breakerStatus{}
+	breakerLock.Lock()
+	for _, cb := range breakers {
+		result = append(result, cb.status())
+	}
+	breakerLock.Unlock()
+
+	spoolLock.Lock()
+	spooled := len(spoolEntries)
+	spoolLock.Unlock()
+
+	writeJSON(w, map[string]interface{}{
+		"breakers": result,
+		"queue": map[string]interface{}{
+			"depth":        len(reportQueue),
+			"capacity":     cap(reportQueue),
+			"busy_workers": atomic.LoadInt64(&busyWorkers),
+		},
+		"spooled": spooled,
+	})
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lavab/raven-go"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Placeholder clients can use to have the user's IP filled in
+const autoIPAddress = "{{auto}}"
+
+// readClientContext fills in the parts of the report's context that come
+// from the request itself.
+func readClientContext(report *models.Report, req *http.Request) {
+	report.UserAgent = req.Header.Get("User-Agent")
+	report.Client = parseUserAgent(report.UserAgent)
+
+	if report.User != nil && report.User.IPAddress == autoIPAddress {
+		report.User.IPAddress = clientIP(req)
+	}
+}
+
+// clientIP returns the address of the client, trusting X-Forwarded-For as
+// lavatrace is usually deployed behind a proxy.
+func clientIP(req *http.Request) string {
+	if forwarded := req.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+
+	return host
+}
+
+// Headers of the report request that also describe the user's page
+var requestHeaders = []string{"User-Agent", "Referer", "Accept-Language"}
+
+// newRequestInterface describes the page the error happened on, or returns
+// nil if the report doesn't say which one it is. The report request itself is
+// lavatrace's, so only the headers the browser also sent for the page are
+// kept.
+func newRequestInterface(report *models.Report, req *http.Request) *raven.Http {
+	if report.URL == "" {
+		return nil
+	}
+	u, err := url.Parse(report.URL)
+	if err != nil {
+		return nil
+	}
+
+	if report.Scrubbed == nil {
+		report.Scrubbed = map[string]int{}
+	}
+
+	h := &raven.Http{
+		Method:  "GET",
+		Query:   u.RawQuery,
+		Headers: map[string]string{},
+	}
+	u.RawQuery = ""
+	u.Fragment = ""
+	h.URL = u.String()
+
+	for _, key := range requestHeaders {
+		if value := req.Header.Get(key); value != "" {
+			h.Headers[key] = scrubString(value, report.Scrubbed)
+		}
+	}
+
+	return h
+}
+
+// addClientContext attaches the report's context and the request interface,
+// if there's any, to a packet.
+func addClientContext(packet *raven.Packet, report *models.Report, h *raven.Http) {
+	tags := map[string]string{}
+	for key, value := range report.Tags {
+		tags[key] = value
+	}
+	if report.Environment != "" {
+		tags["environment"] = report.Environment
+	}
+	if report.Channel != "" {
+		tags["channel"] = report.Channel
+	}
+	if report.Version != "" {
+		tags["version"] = report.Version
+	}
+
+	if client := report.Client; client != nil {
+		if client.Browser != "" {
+			tags["browser"] = strings.TrimSpace(client.Browser + " " + client.BrowserVersion)
+			tags["browser.name"] = client.Browser
+		}
+		if client.OS != "" {
+			tags["os"] = strings.TrimSpace(client.OS + " " + client.OSVersion)
+			tags["os.name"] = client.OS
+		}
+		if client.Device != "" {
+			tags["device"] = client.Device
+		}
+	}
+	packet.AddTags(tags)
+
+	if packet.Extra == nil {
+		packet.Extra = map[string]interface{}{}
+	}
+	for key, value := range report.Extra {
+		packet.Extra[key] = value
+	}
+	if len(report.Scrubbed) > 0 {
+		packet.Extra["scrubbed"] = report.Scrubbed
+	}
+
+	if report.User != nil {
+		packet.Interfaces = append(packet.Interfaces, report.User)
+	}
+	if h != nil {
+		packet.Interfaces = append(packet.Interfaces, h)
+	}
+}
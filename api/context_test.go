@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+func TestNewRequestInterface(t *testing.T) {
+	req, err := http.NewRequest("POST", "https://trace.example.com/report", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	req.Header.Set("Referer", "https://example.com/page")
+	req.Header.Set("Accept-Language", "fr-FR")
+	req.Header.Set("Cookie", "session=secret")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.Header.Set("X-Forwarded-For", "203.0.113.7")
+
+	if h := newRequestInterface(&models.Report{}, req); h != nil {
+		t.Errorf("Reports without a URL got a request interface %+v", h)
+	}
+
+	h := newRequestInterface(&models.Report{
+		URL: "https://example.com/page?tab=2#top",
+	}, req)
+	if h == nil {
+		t.Fatal("Missing request interface")
+	}
+	if h.URL != "https://example.com/page" || h.Query != "tab=2" || h.Method != "GET" {
+		t.Errorf("Invalid page %s %s?%s", h.Method, h.URL, h.Query)
+	}
+	if len(h.Env) != 0 || h.Cookies != "" {
+		t.Errorf("The report request leaked into %+v", h)
+	}
+
+	expected := map[string]string{
+		"User-Agent":      "Mozilla/5.0",
+		"Referer":         "https://example.com/page",
+		"Accept-Language": "fr-FR",
+	}
+	if len(h.Headers) != len(expected) {
+		t.Errorf("Expected headers %v, got %v", expected, h.Headers)
+	}
+	for key, value := range expected {
+		if h.Headers[key] != value {
+			t.Errorf("Expected header %s: %s, got %q", key, value, h.Headers[key])
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"sync"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// dedupeWindow tracks the repeats of the first report with a given content.
+type dedupeWindow struct {
+	ReportID string
+	IssueID  string
+	Repeats  int
+
+	// Closed with the outcome of the first report once it's processed
+	done    chan struct{}
+	dropped string
+	err     error
+
+	// Set until the report is processed, and once the window is over
+	pending bool
+	expired bool
+}
+
+// finish records the outcome of the first report. It must be called with
+// dedupeLock held.
+func (w *dedupeWindow) finish(dropped string, err error) {
+	if !w.pending {
+		return
+	}
+
+	w.pending = false
+	w.dropped = dropped
+	w.err = err
+	close(w.done)
+}
+
+// wait returns the outcome of the first report once it's processed.
+func (w *dedupeWindow) wait() (string, error) {
+	<-w.done
+	return w.dropped, w.err
+}
+
+var (
+	dedupeWindows = map[string]*dedupeWindow{}
+	dedupeLock    sync.Mutex
+)
+
+// Returned to the repeats of a report that wasn't processed after all
+var errReportReleased = &httpError{
+	Code:    503,
+	Message: "Identical report wasn't processed, try again",
+}
+
+// contentHash identifies identical reports by their commit, normalized
+// messages and raw stacktraces.
+func contentHash(report *models.Report) string {
+	hash := sha1.New()
+	hash.Write([]byte(report.CommitID))
+	eachReportEntry(report, func(entry *models.Entry) {
+		hash.Write([]byte("\n" + normalizeMessage(entry.Message) + "\n" + entry.Stacktrace))
+	})
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// reserveReport opens a dedupe window for an accepted report. If one is
+// already open, the repeat is counted and the window of the first report is
+// returned instead.
+func reserveReport(hash, id string) (*dedupeWindow, bool) {
+	if *dedupeWindowFlag <= 0 {
+		return nil, true
+	}
+
+	dedupeLock.Lock()
+	defer dedupeLock.Unlock()
+
+	if window, ok := dedupeWindows[hash]; ok {
+		window.Repeats++
+		return window, false
+	}
+
+	dedupeWindows[hash] = &dedupeWindow{
+		ReportID: id,
+		done:     make(chan struct{}),
+		pending:  true,
+	}
+	time.AfterFunc(*dedupeWindowFlag, func() {
+		closeDedupeWindow(hash, id)
+	})
+
+	return nil, true
+}
+
+// releaseReport closes the window of a report that couldn't be processed so
+// that the next identical report goes through. The repeats waiting for it
+// get the error instead of an event ID that doesn't exist.
+func releaseReport(hash, id string, err error) {
+	dedupeLock.Lock()
+	defer dedupeLock.Unlock()
+
+	if window, ok := dedupeWindows[hash]; ok && window.ReportID == id {
+		delete(dedupeWindows, hash)
+		window.finish("", err)
+	}
+}
+
+// dropReport closes the window of a dropped report. Like the report, its
+// repeats are counted in the issue.
+func dropReport(hash string, report *models.Report, dropped string) {
+	dedupeLock.Lock()
+	window, ok := dedupeWindows[hash]
+	if !ok || window.ReportID != report.ID {
+		dedupeLock.Unlock()
+		return
+	}
+
+	delete(dedupeWindows, hash)
+	window.IssueID = report.IssueID
+	window.finish(dropped, nil)
+	dedupeLock.Unlock()
+
+	countRepeats(window)
+}
+
+// rememberReport completes the window of a processed report. Once it's over,
+// the repeats are attached to the report and counted in its issue.
+func rememberReport(hash string, report *models.Report) {
+	dedupeLock.Lock()
+	window, ok := dedupeWindows[hash]
+	if !ok || window.ReportID != report.ID {
+		dedupeLock.Unlock()
+		return
+	}
+
+	window.IssueID = report.IssueID
+	window.finish("", nil)
+	expired := window.expired
+	if expired {
+		delete(dedupeWindows, hash)
+	}
+	dedupeLock.Unlock()
+
+	if expired {
+		countRepeats(window)
+	}
+}
+
+// closeDedupeWindow ends a window, or lets rememberReport end it if the
+// report is still being processed.
+func closeDedupeWindow(hash, id string) {
+	dedupeLock.Lock()
+	window, ok := dedupeWindows[hash]
+	if !ok || window.ReportID != id {
+		dedupeLock.Unlock()
+		return
+	}
+
+	if window.pending {
+		window.expired = true
+		dedupeLock.Unlock()
+		return
+	}
+	delete(dedupeWindows, hash)
+	dedupeLock.Unlock()
+
+	countRepeats(window)
+}
+
+func countRepeats(window *dedupeWindow) {
+	if window.Repeats == 0 {
+		return
+	}
+
+	// Dropped reports aren't stored
+	if window.dropped == "" {
+		if err := r.DB(*rethinkdbDatabase).Table("reports").Get(window.ReportID).Update(map[string]interface{}{
+			"repeats": window.Repeats,
+		}).Exec(session); err != nil {
+			log.Print("Unable to store the repeats of report " + window.ReportID + ": " + err.Error())
+		}
+	}
+
+	// recordIssue replaces whole issues
+	defer lockIssues(window.IssueID)()
+
+	if err := r.DB(*rethinkdbDatabase).Table("issues").Get(window.IssueID).Update(map[string]interface{}{
+		"count": r.Row.Field("count").Add(window.Repeats),
+	}).Exec(session); err != nil {
+		log.Print("Unable to count the repeats of issue " + window.IssueID + ": " + err.Error())
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	defer func(window time.Duration) {
+		*dedupeWindowFlag = window
+		dedupeWindows = map[string]*dedupeWindow{}
+	}(*dedupeWindowFlag)
+	*dedupeWindowFlag = time.Hour
+
+	if _, ok := reserveReport("hash", "first"); !ok {
+		t.Fatal("Unable to reserve the first report")
+	}
+	window, ok := reserveReport("hash", "repeat")
+	if ok || window.ReportID != "first" || window.Repeats != 1 {
+		t.Fatalf("The repeat wasn't counted: %+v", window)
+	}
+
+	// Repeats of a failed report get its error
+	done := make(chan error)
+	go func() {
+		_, err := window.wait()
+		done <- err
+	}()
+	releaseReport("hash", "first", errReportReleased)
+	if err := <-done; err != errReportReleased {
+		t.Errorf("Expected the release error, got %v", err)
+	}
+
+	// The next identical report goes through
+	if _, ok := reserveReport("hash", "second"); !ok {
+		t.Fatal("The window wasn't released")
+	}
+	window, ok = reserveReport("hash", "repeat")
+	if ok || window.ReportID != "second" {
+		t.Fatalf("The repeat wasn't counted: %+v", window)
+	}
+
+	// Processed reports keep their window open until it expires
+	rememberReport("hash", &models.Report{ID: "second", IssueID: "issue"})
+	if dropped, err := window.wait(); dropped != "" || err != nil {
+		t.Errorf("Unexpected outcome %q, %v", dropped, err)
+	}
+	if window, ok := reserveReport("hash", "repeat"); ok || window.Repeats != 2 || window.IssueID != "issue" {
+		t.Errorf("The window was closed early: %+v", window)
+	}
+}
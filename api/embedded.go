@@ -0,0 +1,192 @@
+package main
+
+import (
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Lines of the stacks generated by the browsers, capturing the function,
+// the URL, the line and the column
+var (
+	// V8: "    at fn (https://example.com/app.js:1:2)" or "    at https://..."
+	v8FramePattern = regexp.MustCompile(`^\s*at (?:(.+?) \()?(.+?):(\d+):(\d+)\)?$`)
+	// SpiderMonkey and JavaScriptCore: "fn@https://example.com/app.js:1:2"
+	geckoFramePattern = regexp.MustCompile(`^\s*(.*?)@(.+?):(\d+):(\d+)$`)
+)
+
+// symbolicateObjects looks for stacks in the log's objects, either as
+// strings or as serialized Errors, and replaces them with resolved frames.
+// The objects are copied first, as they're shared with the stored report.
+func symbolicateObjects(report *models.Report, lo *models.Log) {
+	eachEntry(lo, func(entry *models.LogEntry) {
+		objects, ok := copyValue(entry.Objects).([]interface{})
+		if !ok {
+			return
+		}
+
+		for i, object := range objects {
+			objects[i] = symbolicateValue(report, object, 0)
+		}
+		entry.Objects = objects
+	})
+}
+
+// copyValue deep copies a decoded JSON value.
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case []interface{}:
+		if value == nil {
+			return value
+		}
+		result := make([]interface{}, len(value))
+		for i, item := range value {
+			result[i] = copyValue(item)
+		}
+		return result
+	case map[string]interface{}:
+		if value == nil {
+			return value
+		}
+		result := make(map[string]interface{}, len(value))
+		for key, item := range value {
+			result[key] = copyValue(item)
+		}
+		return result
+	}
+
+	return value
+}
+
+func symbolicateValue(report *models.Report, value interface{}, depth int) interface{} {
+	if depth > *maxObjectDepth {
+		return value
+	}
+
+	switch value := value.(type) {
+	case string:
+		if message, frames, ok := parseStack(report, value); ok {
+			return map[string]interface{}{
+				"message": message,
+				"frames":  frames,
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = symbolicateValue(report, item, depth+1)
+		}
+	case map[string]interface{}:
+		// Serialized Errors keep their name and message
+		if stack, ok := value["stack"].(string); ok {
+			if _, frames, ok := parseStack(report, stack); ok {
+				delete(value, "stack")
+				value["frames"] = frames
+			}
+		}
+
+		for key, item := range value {
+			if key == "frames" {
+				continue
+			}
+			value[key] = symbolicateValue(report, item, depth+1)
+		}
+	}
+
+	return value
+}
+
+// parseStack resolves the frames of a stack string. The lines that aren't
+// frames, usually the error's message, are returned separately. It returns
+// false if the string doesn't contain any frame.
+func parseStack(report *models.Report, stack string) (string, []*models.LogFrame, bool) {
+	message := []string{}
+	frames := []*models.LogFrame{}
+
+	for _, line := range strings.Split(stack, "\n") {
+		match := v8FramePattern.FindStringSubmatch(line)
+		if match == nil {
+			match = geckoFramePattern.FindStringSubmatch(line)
+		}
+		if match == nil {
+			if len(frames) == 0 && strings.TrimSpace(line) != "" {
+				message = append(message, line)
+			}
+			continue
+		}
+
+		if len(frames) >= *maxFrames {
+			break
+		}
+
+		lineNo, _ := strconv.Atoi(match[3])
+		columnNo, _ := strconv.Atoi(match[4])
+		frames = append(frames, resolveFrame(report, match[1], match[2], lineNo, columnNo))
+	}
+
+	if len(frames) == 0 {
+		return "", nil, false
+	}
+
+	return strings.Join(message, "\n"), frames, true
+}
+
+// resolveFrame maps a frame of a stack string through the source map of the
+// report's asset it points to. Frames of other scripts are kept as they are.
+func resolveFrame(report *models.Report, name, url string, lineNo, columnNo int) *models.LogFrame {
+	frame := &models.LogFrame{
+		Filename: url,
+		Name:     name,
+		LineNo:   lineNo,
+		ColNo:    columnNo,
+		AbsPath:  url,
+	}
+	if frame.Name == "" {
+		frame.Name = "unknown"
+	}
+
+	asset, ok := findAsset(report, url)
+	if !ok {
+		return frame
+	}
+
+	mapping, err := getMapping(report.CommitID, path.Base(asset)+".map", lineNo, columnNo)
+	if err != nil || mapping.OriginalFile == "unknown" {
+		return frame
+	}
+
+	frame.Filename = mapping.OriginalFile
+	if mapping.OriginalName != "" {
+		frame.Name = mapping.OriginalName
+	}
+	frame.LineNo = mapping.OriginalLine
+	frame.ColNo = mapping.OriginalColumn
+	frame.InApp = true
+	frame.AbsPath = asset
+
+	return frame
+}
+
+// findAsset matches a script URL against the report's assets, first exactly
+// and then by file name, as the assets are often sent as relative paths.
+func findAsset(report *models.Report, url string) (string, bool) {
+	// Strip the query string and fragment of cache busted URLs
+	if i := strings.IndexAny(url, "?#"); i != -1 {
+		url = url[:i]
+	}
+
+	for _, asset := range report.Assets {
+		if asset == url {
+			return asset, true
+		}
+	}
+	for _, asset := range report.Assets {
+		if path.Base(asset) == path.Base(url) {
+			return asset, true
+		}
+	}
+
+	return "", false
+}
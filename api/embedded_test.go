@@ -0,0 +1,45 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+func TestSymbolicateObjects(t *testing.T) {
+	stack := "Error: failed\n    at load (https://cdn.example.com/lib.js:1:2)"
+	report := &models.Report{
+		Entries: []*models.Entry{
+			{
+				Message: "failed",
+				Objects: []interface{}{
+					stack,
+					map[string]interface{}{
+						"name":  "Error",
+						"stack": stack,
+					},
+				},
+			},
+		},
+	}
+
+	lo, err := buildLog(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+	symbolicateObjects(report, lo)
+
+	// The stored report is left alone
+	objects := report.Entries[0].Objects
+	if objects[0] != stack || objects[1].(map[string]interface{})["stack"] != stack {
+		t.Errorf("The report's objects were modified: %v", objects)
+	}
+
+	logged := lo.Entries[0].Objects.([]interface{})
+	for i, object := range logged {
+		frames, ok := object.(map[string]interface{})["frames"].([]*models.LogFrame)
+		if !ok || len(frames) != 1 || frames[0].Name != "load" || frames[0].LineNo != 1 || frames[0].ColNo != 2 {
+			t.Errorf("Object %d wasn't symbolicated: %v", i, object)
+		}
+	}
+}
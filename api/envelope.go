@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lavab/raven-go"
+)
+
+// Current names of the legacy interfaces
+var envelopeInterfaces = map[string]string{
+	"sentry.interfaces.Http": "request",
+}
+
+// envelopeSink sends events to Sentry's envelope endpoint, which replaced
+// the legacy store endpoint spoken by raven-go.
+type envelopeSink struct {
+	dsn         string
+	url         string
+	authHeader  string
+	attachments bool
+	client      *http.Client
+}
+
+func newEnvelopeSink(config *SinkConfig) (Sink, error) {
+	// Validated by newOutputSink
+	timeout, _ := config.timeout()
+
+	uri, err := url.Parse(config.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if uri.User == nil {
+		return nil, raven.ErrMissingUser
+	}
+
+	auth := "Sentry sentry_version=7, sentry_client=lavatrace/0.1.0, sentry_key=" + uri.User.Username()
+	if secret, ok := uri.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+
+	// The project ID is the last part of the DSN's path
+	index := strings.LastIndex(uri.Path, "/")
+	project := uri.Path[index+1:]
+	if project == "" {
+		return nil, raven.ErrMissingProjectID
+	}
+	uri.User = nil
+	uri.Path = uri.Path[:index+1] + "api/" + project + "/envelope/"
+
+	return &envelopeSink{
+		dsn:         config.DSN,
+		url:         uri.String(),
+		authHeader:  auth,
+		attachments: config.Attachments,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+func (s *envelopeSink) Send(packet *raven.Packet) error {
+	event, err := newEnvelopeEvent(packet)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	body := &bytes.Buffer{}
+	writeEnvelopeLine(body, map[string]interface{}{
+		"event_id": packet.EventID,
+		"dsn":      s.dsn,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339),
+	})
+	writeEnvelopeItem(body, map[string]interface{}{
+		"type": "event",
+	}, payload)
+	if s.attachments {
+		if text := consoleLog(event); text != "" {
+			writeEnvelopeItem(body, map[string]interface{}{
+				"type":         "attachment",
+				"filename":     "console.log",
+				"content_type": "text/plain",
+			}, []byte(text))
+		}
+	}
+
+	req, err := http.NewRequest("POST", s.url, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", s.authHeader)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Sentry returned %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// newEnvelopeEvent converts a legacy packet into an event payload, moving
+// the environment and the parsed user agent to their own fields.
+func newEnvelopeEvent(packet *raven.Packet) (map[string]interface{}, error) {
+	var event map[string]interface{}
+	if err := json.Unmarshal(packet.JSON(), &event); err != nil {
+		return nil, err
+	}
+	if event == nil {
+		return nil, errors.New("Empty packet")
+	}
+
+	for legacy, name := range envelopeInterfaces {
+		if value, ok := event[legacy]; ok {
+			event[name] = value
+			delete(event, legacy)
+		}
+	}
+	delete(event, "project")
+	if packet.Logger == "" {
+		delete(event, "logger")
+	}
+
+	// Unix timestamps don't depend on the timezone
+	date := time.Time(packet.Timestamp)
+	if date.IsZero() {
+		date = time.Now()
+	}
+	event["timestamp"] = float64(date.UnixNano()) / 1e9
+
+	tags := map[string]string{}
+	for _, tag := range packet.Tags {
+		tags[tag.Key] = tag.Value
+	}
+	event["tags"] = tags
+	if environment, ok := tags["environment"]; ok {
+		event["environment"] = environment
+	}
+
+	contexts := map[string]interface{}{}
+	for _, kind := range []string{"browser", "os"} {
+		name, ok := tags[kind+".name"]
+		if !ok {
+			continue
+		}
+		context := map[string]string{
+			"name": name,
+		}
+		if version := strings.TrimSpace(strings.TrimPrefix(tags[kind], name)); version != "" {
+			context["version"] = version
+		}
+		contexts[kind] = context
+	}
+	if device, ok := tags["device"]; ok {
+		contexts["device"] = map[string]string{
+			"family": device,
+		}
+	}
+	if len(contexts) > 0 {
+		event["contexts"] = contexts
+	}
+
+	return event, nil
+}
+
+// consoleLog renders an event's breadcrumbs as text, as Sentry only keeps
+// the last ones.
+func consoleLog(event map[string]interface{}) string {
+	var breadcrumbs struct {
+		Values []struct {
+			Timestamp float64 `json:"timestamp"`
+			Level     string  `json:"level"`
+			Message   string  `json:"message"`
+		} `json:"values"`
+	}
+	data, err := json.Marshal(event["breadcrumbs"])
+	if err != nil || json.Unmarshal(data, &breadcrumbs) != nil {
+		return ""
+	}
+
+	text := &bytes.Buffer{}
+	for _, breadcrumb := range breadcrumbs.Values {
+		date := time.Unix(0, int64(breadcrumb.Timestamp*1e9)).UTC()
+		fmt.Fprintf(text, "%s [%s] %s\n", date.Format(time.RFC3339Nano), breadcrumb.Level, breadcrumb.Message)
+	}
+
+	return text.String()
+}
+
+func writeEnvelopeLine(w *bytes.Buffer, header map[string]interface{}) {
+	data, _ := json.Marshal(header)
+	w.Write(data)
+	w.WriteByte('\n')
+}
+
+// writeEnvelopeItem appends an item with an explicit length, so that the
+// payload may contain newlines.
+func writeEnvelopeItem(w *bytes.Buffer, header map[string]interface{}, payload []byte) {
+	header["length"] = len(payload)
+	writeEnvelopeLine(w, header)
+	w.Write(payload)
+	w.WriteByte('\n')
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lavab/raven-go"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// envelopeItem is an item of a posted envelope.
+type envelopeItem struct {
+	Header  map[string]interface{}
+	Payload []byte
+}
+
+// parseEnvelope splits an envelope into its header and items, checking the
+// item lengths.
+func parseEnvelope(t *testing.T, body []byte) (map[string]interface{}, []*envelopeItem) {
+	line := func() []byte {
+		i := bytes.IndexByte(body, '\n')
+		if i == -1 {
+			t.Fatalf("Missing newline in %q", body)
+		}
+		result := body[:i]
+		body = body[i+1:]
+		return result
+	}
+
+	var header map[string]interface{}
+	if err := json.Unmarshal(line(), &header); err != nil {
+		t.Fatal(err)
+	}
+
+	items := []*envelopeItem{}
+	for len(body) > 0 {
+		item := &envelopeItem{}
+		if err := json.Unmarshal(line(), &item.Header); err != nil {
+			t.Fatal(err)
+		}
+
+		length, ok := item.Header["length"].(float64)
+		if !ok {
+			t.Fatalf("Item without a length: %v", item.Header)
+		}
+		if int(length) > len(body) {
+			t.Fatalf("Item length %d exceeds the %d remaining bytes", int(length), len(body))
+		}
+		item.Payload = body[:int(length)]
+		body = body[int(length):]
+		if len(body) == 0 || body[0] != '\n' {
+			t.Fatalf("Item of type %v isn't followed by a newline", item.Header["type"])
+		}
+		body = body[1:]
+
+		items = append(items, item)
+	}
+
+	return header, items
+}
+
+// testPacket builds the packet of a report with a breadcrumb and a chained
+// error.
+func testPacket() *raven.Packet {
+	report := &models.Report{
+		ID:          newEventID(),
+		CommitID:    "abc",
+		Environment: "production",
+		Client: &models.Client{
+			Browser:        "Chrome",
+			BrowserVersion: "120.0",
+			OS:             "Linux",
+		},
+		ReceivedAt: time.Unix(1700000000, 0),
+	}
+	lo := &models.Log{
+		Entries: []*models.LogEntry{
+			{
+				Type:    "log",
+				Message: "loading\nthe page",
+				Date:    1700000000000,
+			},
+			{
+				Type:    "error",
+				Message: "TypeError: x is undefined",
+				Frames: []*models.LogFrame{
+					{Filename: "app.js", Name: "render", LineNo: 1, ColNo: 2, InApp: true},
+				},
+				Cause: &models.LogEntry{
+					Type:    "error",
+					Message: "Error: network down",
+				},
+			},
+		},
+	}
+
+	packet := newPacket(report, lo)
+	addClientContext(packet, report, &raven.Http{
+		URL:    "https://example.com/page",
+		Method: "GET",
+	})
+	packet.EventID = report.ID
+	packet.Timestamp = raven.Timestamp(report.ReceivedAt)
+
+	return packet
+}
+
+func TestEnvelopeSink(t *testing.T) {
+	var (
+		path, auth, contentType string
+		body                    []byte
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		path = req.URL.Path
+		auth = req.Header.Get("X-Sentry-Auth")
+		contentType = req.Header.Get("Content-Type")
+		body, _ = ioutil.ReadAll(req.Body)
+	}))
+	defer server.Close()
+
+	dsn := strings.Replace(server.URL, "http://", "http://public:secret@", 1) + "/sentry/42"
+	sink, err := newEnvelopeSink(&SinkConfig{
+		Type:        "sentry_envelope",
+		DSN:         dsn,
+		Attachments: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packet := testPacket()
+	if err := sink.Send(packet); err != nil {
+		t.Fatal(err)
+	}
+
+	// Endpoint and authentication derived from the DSN
+	if path != "/sentry/api/42/envelope/" {
+		t.Errorf("Posted to %s", path)
+	}
+	for _, part := range []string{"Sentry sentry_version=7", "sentry_key=public", "sentry_secret=secret"} {
+		if !strings.Contains(auth, part) {
+			t.Errorf("X-Sentry-Auth %q doesn't contain %q", auth, part)
+		}
+	}
+	if contentType != "application/x-sentry-envelope" {
+		t.Errorf("Content-Type is %s", contentType)
+	}
+
+	header, items := parseEnvelope(t, body)
+	if header["event_id"] != packet.EventID || header["dsn"] != dsn {
+		t.Errorf("Invalid envelope header %v", header)
+	}
+	if _, err := time.Parse(time.RFC3339, header["sent_at"].(string)); err != nil {
+		t.Errorf("Invalid sent_at: %v", err)
+	}
+	if len(items) != 2 || items[0].Header["type"] != "event" || items[1].Header["type"] != "attachment" {
+		t.Fatalf("Expected an event and an attachment, got %d items", len(items))
+	}
+
+	var event struct {
+		EventID     string  `json:"event_id"`
+		Timestamp   float64 `json:"timestamp"`
+		Level       string  `json:"level"`
+		Environment string  `json:"environment"`
+		Exception   struct {
+			Values []struct {
+				Type       string `json:"type"`
+				Value      string `json:"value"`
+				Stacktrace *struct {
+					Frames []map[string]interface{} `json:"frames"`
+				} `json:"stacktrace"`
+			} `json:"values"`
+		} `json:"exception"`
+		Breadcrumbs struct {
+			Values []map[string]interface{} `json:"values"`
+		} `json:"breadcrumbs"`
+		Contexts map[string]map[string]string `json:"contexts"`
+		Request  map[string]interface{}       `json:"request"`
+		Tags     map[string]string            `json:"tags"`
+	}
+	if err := json.Unmarshal(items[0].Payload, &event); err != nil {
+		t.Fatal(err)
+	}
+
+	if event.EventID != packet.EventID || event.Timestamp != 1700000000 || event.Level != "error" {
+		t.Errorf("Invalid event attributes %+v", event)
+	}
+	if event.Environment != "production" || event.Tags["environment"] != "production" {
+		t.Errorf("Invalid environment %q", event.Environment)
+	}
+
+	// The main exception is last, the cause has no frames
+	values := event.Exception.Values
+	if len(values) != 2 {
+		t.Fatalf("Expected 2 exceptions, got %d", len(values))
+	}
+	if values[0].Value != "network down" || values[0].Stacktrace != nil {
+		t.Errorf("Invalid cause %+v", values[0])
+	}
+	if values[1].Type != "TypeError" || values[1].Value != "x is undefined" || values[1].Stacktrace == nil || len(values[1].Stacktrace.Frames) != 1 {
+		t.Errorf("Invalid exception %+v", values[1])
+	}
+
+	if len(event.Breadcrumbs.Values) != 1 || event.Breadcrumbs.Values[0]["message"] != "loading\nthe page" {
+		t.Errorf("Invalid breadcrumbs %v", event.Breadcrumbs.Values)
+	}
+	if browser := event.Contexts["browser"]; browser["name"] != "Chrome" || browser["version"] != "120.0" {
+		t.Errorf("Invalid browser context %v", browser)
+	}
+	if system := event.Contexts["os"]; system["name"] != "Linux" || system["version"] != "" {
+		t.Errorf("Invalid OS context %v", system)
+	}
+	if event.Request["url"] != "https://example.com/page" {
+		t.Errorf("Invalid request %v", event.Request)
+	}
+
+	attachment := items[1]
+	if attachment.Header["filename"] != "console.log" || attachment.Header["content_type"] != "text/plain" {
+		t.Errorf("Invalid attachment header %v", attachment.Header)
+	}
+	if expected := "2023-11-14T22:13:20Z [info] loading\nthe page\n"; string(attachment.Payload) != expected {
+		t.Errorf("Expected attachment %q, got %q", expected, attachment.Payload)
+	}
+}
+
+func TestEnvelopeSinkErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(429)
+	}))
+	defer server.Close()
+
+	sink, err := newEnvelopeSink(&SinkConfig{
+		DSN: strings.Replace(server.URL, "http://", "http://public@", 1) + "/42",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Send(testPacket()); err == nil || !strings.Contains(err.Error(), "429") {
+		t.Errorf("Expected the status in the error, got %v", err)
+	}
+
+	for _, dsn := range []string{"http://example.com/42", "http://public@example.com/"} {
+		if _, err := newEnvelopeSink(&SinkConfig{DSN: dsn}); err == nil {
+			t.Errorf("Expected an error for %s", dsn)
+		}
+	}
+}
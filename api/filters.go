@@ -0,0 +1,408 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/goji/web"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Filters created on the first start, identified by their type. They can
+// be disabled but not deleted.
+var defaultFilters = []*models.Filter{
+	{
+		ID:          models.FilterBrowserExtension,
+		Type:        models.FilterBrowserExtension,
+		Description: "Errors caused by browser extensions",
+		Enabled:     true,
+	},
+	{
+		ID:          models.FilterCrawler,
+		Type:        models.FilterCrawler,
+		Description: "Reports sent by crawlers and headless browsers",
+		Enabled:     true,
+	},
+	{
+		ID:          models.FilterLegacyBrowser,
+		Type:        models.FilterLegacyBrowser,
+		Pattern:     "Internet Explorer<11",
+		Description: "Reports sent by unsupported browsers",
+		Enabled:     true,
+	},
+	{
+		ID:          models.FilterScriptError,
+		Type:        models.FilterScriptError,
+		Description: `Cross-origin "Script error." without a stacktrace`,
+		Enabled:     true,
+	},
+}
+
+var extensionPattern = regexp.MustCompile(`(?i)\b(?:chrome|moz|safari(?:-web)?|ms-browser|edge)-extension://`)
+
+var scriptErrorPattern = regexp.MustCompile(`^Script error\.?$`)
+
+// compiledFilter is a filter ready to be matched against reports.
+type compiledFilter struct {
+	*models.Filter
+	pattern  *regexp.Regexp
+	browsers map[string]string
+	dropped  *int64
+}
+
+var (
+	// Enabled filters, replaced whenever they're edited
+	activeFilters []*compiledFilter
+	filterLock    sync.RWMutex
+
+	// Number of dropped reports by filter ID since the start. Counters are
+	// kept when the filters are reloaded.
+	filterDrops = map[string]*int64{}
+)
+
+// compileFilter validates a filter and prepares its pattern.
+func compileFilter(filter *models.Filter) (*compiledFilter, error) {
+	cf := &compiledFilter{
+		Filter: filter,
+	}
+
+	switch filter.Type {
+	case models.FilterBrowserExtension, models.FilterCrawler, models.FilterScriptError:
+	case models.FilterMessage, models.FilterURL, models.FilterUserAgent:
+		if filter.Pattern == "" {
+			return nil, errors.New("A pattern is required")
+		}
+
+		pattern, err := regexp.Compile(filter.Pattern)
+		if err != nil {
+			return nil, err
+		}
+		cf.pattern = pattern
+	case models.FilterLegacyBrowser:
+		// Comma-separated browser<version pairs
+		cf.browsers = map[string]string{}
+		for _, part := range strings.Split(filter.Pattern, ",") {
+			if strings.TrimSpace(part) == "" {
+				continue
+			}
+
+			pair := strings.SplitN(part, "<", 2)
+			if len(pair) != 2 || strings.TrimSpace(pair[0]) == "" || strings.TrimSpace(pair[1]) == "" {
+				return nil, errors.New("Invalid browser version " + part)
+			}
+			cf.browsers[strings.TrimSpace(pair[0])] = strings.TrimSpace(pair[1])
+		}
+	default:
+		return nil, errors.New("Unknown filter type " + filter.Type)
+	}
+
+	return cf, nil
+}
+
+// loadFilters reloads the enabled filters from the database.
+func loadFilters() error {
+	cursor, err := r.DB(*rethinkdbDatabase).Table("filters").OrderBy("date").Run(session)
+	if err != nil {
+		return err
+	}
+	var filters []*models.Filter
+	if err := cursor.All(&filters); err != nil {
+		return err
+	}
+
+	filterLock.Lock()
+	defer filterLock.Unlock()
+
+	active := []*compiledFilter{}
+	for _, filter := range filters {
+		if !filter.Enabled {
+			continue
+		}
+
+		cf, err := compileFilter(filter)
+		if err != nil {
+			return errors.New("Filter " + filter.ID + ": " + err.Error())
+		}
+
+		if _, ok := filterDrops[filter.ID]; !ok {
+			filterDrops[filter.ID] = new(int64)
+		}
+		cf.dropped = filterDrops[filter.ID]
+
+		active = append(active, cf)
+	}
+	activeFilters = active
+
+	return nil
+}
+
+// filterReport returns the first enabled filter matching the report,
+// counting the drop.
+func filterReport(report *models.Report) (*models.Filter, bool) {
+	filterLock.RLock()
+	defer filterLock.RUnlock()
+
+	for _, cf := range activeFilters {
+		if cf.matches(report) {
+			atomic.AddInt64(cf.dropped, 1)
+			return cf.Filter, true
+		}
+	}
+
+	return nil, false
+}
+
+func (cf *compiledFilter) matches(report *models.Report) bool {
+	switch cf.Type {
+	case models.FilterBrowserExtension:
+		for _, asset := range report.Assets {
+			if extensionPattern.MatchString(asset) {
+				return true
+			}
+		}
+		return anyMessage(report, extensionPattern)
+	case models.FilterCrawler:
+		return report.Client != nil && report.Client.Device == "bot"
+	case models.FilterLegacyBrowser:
+		if report.Client == nil || report.Client.BrowserVersion == "" {
+			return false
+		}
+		min, ok := cf.browsers[report.Client.Browser]
+		return ok && compareVersions(report.Client.BrowserVersion, min) < 0
+	case models.FilterScriptError:
+		// Browsers hide the details of errors thrown by cross-origin scripts
+		last := report.Entries[len(report.Entries)-1]
+		return scriptErrorPattern.MatchString(strings.TrimSpace(last.Message)) && last.Stacktrace == ""
+	case models.FilterMessage:
+		return anyMessage(report, cf.pattern)
+	case models.FilterURL:
+		if cf.pattern.MatchString(report.URL) {
+			return true
+		}
+		for _, asset := range report.Assets {
+			if cf.pattern.MatchString(asset) {
+				return true
+			}
+		}
+	case models.FilterUserAgent:
+		return cf.pattern.MatchString(report.UserAgent)
+	}
+
+	return false
+}
+
+func anyMessage(report *models.Report, pattern *regexp.Regexp) bool {
+	found := false
+	eachReportEntry(report, func(entry *models.Entry) {
+		if !found && pattern.MatchString(entry.Message) {
+			found = true
+		}
+	})
+
+	return found
+}
+
+func isDefaultFilter(id string) bool {
+	for _, filter := range defaultFilters {
+		if filter.ID == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// filterStatus is a filter along with its drop counter.
+type filterStatus struct {
+	*models.Filter
+	Dropped int64 `json:"dropped"`
+}
+
+// GET /filters - lists the inbound filters and how many reports each of
+// them dropped since the start
+func listFilters(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	cursor, err := r.DB(*rethinkdbDatabase).Table("filters").OrderBy("date").Run(session)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var filters []*models.Filter
+	if err := cursor.All(&filters); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	result := []*filterStatus{}
+	filterLock.RLock()
+	for _, filter := range filters {
+		status := &filterStatus{
+			Filter: filter,
+		}
+		if dropped, ok := filterDrops[filter.ID]; ok {
+			status.Dropped = atomic.LoadInt64(dropped)
+		}
+		result = append(result, status)
+	}
+	filterLock.RUnlock()
+
+	writeJSON(w, result)
+}
+
+// POST /filters - {"type": "", "pattern": "", "description": "", "enabled": true}
+func createFilter(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Type        string `json:"type"`
+		Pattern     string `json:"pattern"`
+		Description string `json:"description"`
+		Enabled     *bool  `json:"enabled"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	filter := &models.Filter{
+		ID:          uniuri.NewLen(uniuri.UUIDLen),
+		Type:        input.Type,
+		Pattern:     input.Pattern,
+		Description: input.Description,
+		Enabled:     input.Enabled == nil || *input.Enabled,
+		Date:        time.Now(),
+	}
+	if _, err := compileFilter(filter); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := r.DB(*rethinkdbDatabase).Table("filters").Insert(filter).Exec(session); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := loadFilters(); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, filter)
+}
+
+// PUT /filters/:id - {"pattern": "", "description": "", "enabled": false},
+// omitted fields are left unchanged
+func updateFilter(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Pattern     *string `json:"pattern"`
+		Description *string `json:"description"`
+		Enabled     *bool   `json:"enabled"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	cursor, err := r.DB(*rethinkdbDatabase).Table("filters").Get(c.URLParams["id"]).Run(session)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var filter *models.Filter
+	if err := cursor.One(&filter); err != nil {
+		if err == r.ErrEmptyResult {
+			w.WriteHeader(404)
+			w.Write([]byte("Filter not found"))
+			return
+		}
+
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if input.Pattern != nil {
+		filter.Pattern = *input.Pattern
+	}
+	if input.Description != nil {
+		filter.Description = *input.Description
+	}
+	if input.Enabled != nil {
+		filter.Enabled = *input.Enabled
+	}
+	if _, err := compileFilter(filter); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := r.DB(*rethinkdbDatabase).Table("filters").Get(filter.ID).Replace(filter).Exec(session); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := loadFilters(); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, filter)
+}
+
+// DELETE /filters/:id
+func deleteFilter(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	id := c.URLParams["id"]
+	if isDefaultFilter(id) {
+		w.WriteHeader(400)
+		w.Write([]byte("Default filters can only be disabled"))
+		return
+	}
+
+	resp, err := r.DB(*rethinkdbDatabase).Table("filters").Get(id).Delete().RunWrite(session)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if resp.Deleted == 0 {
+		w.WriteHeader(404)
+		w.Write([]byte("Filter not found"))
+		return
+	}
+	if err := loadFilters(); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	w.Write([]byte("Success"))
+}
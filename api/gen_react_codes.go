@@ -0,0 +1,97 @@
+//go:build ignore
+// +build ignore
+
+// gen_react_codes generates react_codes.go from React's codes.json, either
+// downloaded from the React repository or read from a local copy:
+//
+//	go run gen_react_codes.go [codes.json]
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"go/format"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const codesURL = "https://raw.githubusercontent.com/facebook/react/main/scripts/error-codes/codes.json"
+
+func main() {
+	var (
+		data []byte
+		err  error
+	)
+	if len(os.Args) > 1 {
+		data, err = ioutil.ReadFile(os.Args[1])
+	} else {
+		data, err = download(codesURL)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var codes map[string]string
+	if err := json.Unmarshal(data, &codes); err != nil {
+		log.Fatal(err)
+	}
+
+	keys := []string{}
+	for code := range codes {
+		if _, err := strconv.Atoi(code); err != nil {
+			log.Fatal("Invalid code " + code)
+		}
+		keys = append(keys, code)
+	}
+	sort.Sort(byNumber(keys))
+
+	buf := &bytes.Buffer{}
+	fmt.Fprintln(buf, "// Code generated by gen_react_codes.go; DO NOT EDIT.")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "package main")
+	fmt.Fprintln(buf)
+	fmt.Fprintln(buf, "// reactErrorCodes is the bundled copy of React's scripts/error-codes/codes.json.")
+	fmt.Fprintln(buf, "// A newer copy can be merged at runtime with -react_error_codes.")
+	fmt.Fprintln(buf, "var reactErrorCodes = map[string]string{")
+	for _, code := range keys {
+		fmt.Fprintf(buf, "\t%q: %s,\n", code, strconv.Quote(codes[code]))
+	}
+	fmt.Fprintln(buf, "}")
+
+	source, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile("react_codes.go", source, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func download(url string) ([]byte, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Download returned %d", resp.StatusCode)
+	}
+
+	return ioutil.ReadAll(resp.Body)
+}
+
+type byNumber []string
+
+func (s byNumber) Len() int      { return len(s) }
+func (s byNumber) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byNumber) Less(i, j int) bool {
+	x, _ := strconv.Atoi(s[i])
+	y, _ := strconv.Atoi(s[j])
+	return x < y
+}
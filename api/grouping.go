@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Rules loaded from the config on startup
+var groupingRules []*GroupingRule
+
+// GroupingRule changes how frames are grouped, for example:
+//
+//	path:**/vendor/** -app
+//	function:dispatch* -group
+//	message:/ChunkLoadError/ fingerprint=chunk-load
+//
+// All matchers have to match. Frame matchers (path, function) select the
+// frames that +app/-app and +group/-group apply to. If any of them matches,
+// fingerprint= forces the fingerprint of the whole report.
+type GroupingRule struct {
+	Raw         string
+	Message     *regexp.Regexp
+	Path        *regexp.Regexp
+	Function    *regexp.Regexp
+	InApp       *bool
+	Group       *bool
+	Fingerprint string
+}
+
+var ruleToken = regexp.MustCompile(`(\w+):(/(?:\\.|[^/])*/|"(?:\\.|[^"])*"|\S+)|\S+`)
+
+// parseGroupingRules parses one rule per line, ignoring blank lines and
+// comments starting with #.
+func parseGroupingRules(input string) ([]*GroupingRule, error) {
+	rules := []*GroupingRule{}
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseGroupingRule(line)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseGroupingRule(line string) (*GroupingRule, error) {
+	rule := &GroupingRule{
+		Raw: line,
+	}
+
+	yes, no := true, false
+	for _, token := range ruleToken.FindAllStringSubmatch(line, -1) {
+		switch {
+		case token[1] != "":
+			pattern, err := matcherPattern(token[1], token[2])
+			if err != nil {
+				return nil, err
+			}
+
+			switch token[1] {
+			case "message":
+				rule.Message = pattern
+			case "path":
+				rule.Path = pattern
+			case "function":
+				rule.Function = pattern
+			default:
+				return nil, errors.New("unknown matcher " + token[1])
+			}
+		case token[0] == "+app":
+			rule.InApp = &yes
+		case token[0] == "-app":
+			rule.InApp = &no
+		case token[0] == "+group":
+			rule.Group = &yes
+		case token[0] == "-group":
+			rule.Group = &no
+		case strings.HasPrefix(token[0], "fingerprint="):
+			rule.Fingerprint = strings.TrimPrefix(token[0], "fingerprint=")
+			if rule.Fingerprint == "" {
+				return nil, errors.New("empty fingerprint")
+			}
+		default:
+			return nil, errors.New("invalid token " + token[0])
+		}
+	}
+
+	if rule.Message == nil && rule.Path == nil && rule.Function == nil {
+		return nil, errors.New("rule has no matchers")
+	}
+	if rule.InApp == nil && rule.Group == nil && rule.Fingerprint == "" {
+		return nil, errors.New("rule has no actions")
+	}
+	if rule.Path == nil && rule.Function == nil && (rule.InApp != nil || rule.Group != nil) {
+		return nil, errors.New("frame actions require a path or function matcher")
+	}
+
+	return rule, nil
+}
+
+// matcherPattern compiles a matcher value. /.../ values are regular
+// expressions, other values are globs where * doesn't cross path separators
+// and ** does.
+func matcherPattern(field, value string) (*regexp.Regexp, error) {
+	if len(value) >= 2 && value[0] == '/' && value[len(value)-1] == '/' {
+		return regexp.Compile(value[1 : len(value)-1])
+	}
+	if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+		value = value[1 : len(value)-1]
+	}
+
+	var pattern string
+	for i := 0; i < len(value); i++ {
+		switch {
+		case strings.HasPrefix(value[i:], "**"):
+			pattern += ".*"
+			i++
+		case value[i] == '*':
+			pattern += "[^/]*"
+		case value[i] == '?':
+			pattern += "[^/]"
+		default:
+			pattern += regexp.QuoteMeta(value[i : i+1])
+		}
+	}
+
+	flags := ""
+	if field == "path" {
+		flags = "(?i)"
+	}
+
+	return regexp.Compile(flags + "^" + pattern + "$")
+}
+
+func (g *GroupingRule) matchesFrame(frame *models.LogFrame) bool {
+	if g.Path != nil && !g.Path.MatchString(frame.AbsPath) && !g.Path.MatchString(frame.Filename) {
+		return false
+	}
+	if g.Function != nil && !g.Function.MatchString(frame.Name) {
+		return false
+	}
+
+	return true
+}
+
+// applyGroupingRules updates the in-app and grouping flags of the log's
+// frames, returning the forced fingerprint if any rule set one.
+func applyGroupingRules(rules []*GroupingRule, lo *models.Log) string {
+	message := ""
+	if len(lo.Entries) > 0 {
+		message = lo.Entries[len(lo.Entries)-1].Message
+	}
+
+	// Grouping follows in-app status unless a rule says otherwise
+	groups := map[*models.LogFrame]bool{}
+
+	forced := ""
+	for _, rule := range rules {
+		if rule.Message != nil && !rule.Message.MatchString(message) {
+			continue
+		}
+
+		// Message-only rules
+		if rule.Path == nil && rule.Function == nil {
+			if rule.Fingerprint != "" {
+				forced = rule.Fingerprint
+			}
+			continue
+		}
+
+		eachEntry(lo, func(entry *models.LogEntry) {
+			for _, frame := range entry.Frames {
+				if !rule.matchesFrame(frame) {
+					continue
+				}
+
+				if rule.InApp != nil {
+					frame.InApp = *rule.InApp
+				}
+				if rule.Group != nil {
+					groups[frame] = *rule.Group
+				}
+				if rule.Fingerprint != "" {
+					forced = rule.Fingerprint
+				}
+			}
+		})
+	}
+
+	eachEntry(lo, func(entry *models.LogEntry) {
+		for _, frame := range entry.Frames {
+			if group, ok := groups[frame]; ok {
+				frame.Group = group
+			} else {
+				frame.Group = frame.InApp
+			}
+		}
+	})
+
+	return forced
+}
+
+// groupLog applies the grouping rules and returns the log's fingerprint.
+func groupLog(rules []*GroupingRule, lo *models.Log) string {
+	if forced := applyGroupingRules(rules, lo); forced != "" {
+		return forced
+	}
+
+	return fingerprint(lo)
+}
+
+// POST /grouping/test - {"rules": "", "report": {...}}, dry-runs the grouping
+// of a report using either the given rules or the loaded ones
+func testGrouping(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Rules  *string          `json:"rules"`
+		Report *json.RawMessage `json:"report"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if input.Report == nil {
+		w.WriteHeader(400)
+		w.Write([]byte("Missing report"))
+		return
+	}
+
+	rules := groupingRules
+	if input.Rules != nil {
+		var err error
+		rules, err = parseGroupingRules(*input.Rules)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	// Same validation and v2 conversion as the reports
+	report, err := parseReport(*input.Report)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	lo, err := prepareLog(report)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	type frameResult struct {
+		Filename string `json:"filename"`
+		Name     string `json:"name"`
+		AbsPath  string `json:"abs_path"`
+		InApp    bool   `json:"in_app"`
+		Group    bool   `json:"group"`
+	}
+	type entryResult struct {
+		Message string         `json:"message"`
+		Frames  []*frameResult `json:"frames"`
+	}
+	result := struct {
+		Fingerprint string         `json:"fingerprint"`
+		Entries     []*entryResult `json:"entries"`
+	}{
+		Fingerprint: groupLog(rules, lo),
+		Entries:     []*entryResult{},
+	}
+
+	for _, entry := range lo.Entries {
+		er := &entryResult{
+			Message: entry.Message,
+			Frames:  []*frameResult{},
+		}
+		for _, frame := range entry.Frames {
+			er.Frames = append(er.Frames, &frameResult{
+				Filename: frame.Filename,
+				Name:     frame.Name,
+				AbsPath:  frame.AbsPath,
+				InApp:    frame.InApp,
+				Group:    frame.Group,
+			})
+		}
+		result.Entries = append(result.Entries, er)
+	}
+
+	writeJSON(w, result)
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Event IDs of the reports currently being processed by their keys
+var (
+	pendingKeys    = map[string]string{}
+	pendingKeyLock sync.Mutex
+)
+
+// idempotencyKey returns the client-generated ID of a report, either from
+// its body or from the Idempotency-Key header.
+func idempotencyKey(report *models.Report, req *http.Request) string {
+	if report.ReportID != "" {
+		return report.ReportID
+	}
+
+	key := req.Header.Get("Idempotency-Key")
+	if len(key) > 128 {
+		key = key[:128]
+	}
+
+	return key
+}
+
+// findReportByKey returns the event ID of a report accepted with the key
+// within the idempotency period.
+func findReportByKey(key string) (string, bool, error) {
+	cursor, err := r.DB(*rethinkdbDatabase).Table("report_keys").Get(key).Run(session)
+	if err != nil {
+		return "", false, err
+	}
+
+	var result *models.ReportKey
+	if err := cursor.One(&result); err != nil {
+		if err == r.ErrEmptyResult {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	if result == nil || result.Date.Before(time.Now().Add(-*idempotencyTTL)) {
+		return "", false, nil
+	}
+
+	return result.EventID, true, nil
+}
+
+// rememberKey records the event ID of a report's key once the report is
+// counted, so that retries get the same answer.
+func rememberKey(report *models.Report) {
+	if report.ReportID == "" {
+		return
+	}
+
+	if err := r.DB(*rethinkdbDatabase).Table("report_keys").Insert(&models.ReportKey{
+		ID:      report.ReportID,
+		EventID: report.ID,
+		Date:    time.Now(),
+	}, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(session); err != nil {
+		log.Print("Unable to store the key of report " + report.ID + ": " + err.Error())
+	}
+}
+
+// expireReportKeys periodically deletes the keys that are past the
+// idempotency period.
+func expireReportKeys() {
+	for range time.Tick(time.Hour) {
+		if err := r.DB(*rethinkdbDatabase).Table("report_keys").Between(r.MinVal, time.Now().Add(-*idempotencyTTL), r.BetweenOpts{
+			Index: "date",
+		}).Delete().Exec(session); err != nil {
+			log.Print("Unable to delete the expired report keys: " + err.Error())
+		}
+	}
+}
+
+// lockKey marks a key as being processed as an event. If it already is, it
+// returns the ID of the first event.
+func lockKey(key, eid string) (string, bool) {
+	pendingKeyLock.Lock()
+	defer pendingKeyLock.Unlock()
+
+	if pending, ok := pendingKeys[key]; ok {
+		return pending, false
+	}
+	pendingKeys[key] = eid
+
+	return eid, true
+}
+
+func unlockKey(key string) {
+	pendingKeyLock.Lock()
+	delete(pendingKeys, key)
+	pendingKeyLock.Unlock()
+}
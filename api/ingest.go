@@ -0,0 +1,148 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/lavab/raven-go"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// reportJob is a validated report waiting to be symbolicated and delivered.
+type reportJob struct {
+	Report  *models.Report
+	Request *raven.Http
+
+	// Content hash for the dedupe window
+	Hash string
+}
+
+var reportQueue chan *reportJob
+
+// Queue metrics since the start
+var (
+	busyWorkers      int64
+	processedReports int64
+	failedReports    int64
+)
+
+// startWorkers creates the queue and starts the worker pool.
+func startWorkers() {
+	reportQueue = make(chan *reportJob, *queueSize)
+
+	for i := 0; i < *workers; i++ {
+		go func() {
+			for job := range reportQueue {
+				atomic.AddInt64(&busyWorkers, 1)
+				if _, err := processReport(job); err != nil {
+					atomic.AddInt64(&failedReports, 1)
+					log.Print("Unable to process report " + job.Report.ID + ": " + err.Error())
+				} else {
+					atomic.AddInt64(&processedReports, 1)
+				}
+				atomic.AddInt64(&busyWorkers, -1)
+			}
+		}()
+	}
+}
+
+// enqueueReport queues a job without blocking, returning false if the
+// queue is full.
+func enqueueReport(job *reportJob) bool {
+	select {
+	case reportQueue <- job:
+		return true
+	default:
+		return false
+	}
+}
+
+// processReport symbolicates, groups, stores and sends a report. It returns
+// the reason why the report was dropped, if it was.
+func processReport(job *reportJob) (dropped string, err error) {
+	report := job.Report
+	if report.ReportID != "" {
+		defer unlockKey(report.ReportID)
+	}
+
+	// Identical reports are held back until this one is processed
+	defer func() {
+		switch {
+		case err != nil:
+			releaseReport(job.Hash, report.ID, err)
+		case dropped != "":
+			dropReport(job.Hash, report, dropped)
+		default:
+			rememberReport(job.Hash, report)
+		}
+	}()
+
+	// Symbolicate the stacktraces
+	lo, err := prepareLog(report)
+	if err != nil {
+		return "", err
+	}
+
+	// Apply the grouping rules before anything reads the frames
+	report.Fingerprint = groupLog(groupingRules, lo)
+
+	// Prepare a new packet
+	packet := newPacket(report, lo)
+	addClientContext(packet, report, job.Request)
+
+	// Dropped reports are still counted in their issue
+	dropped = sampleReport(report, packet.Message)
+
+	// Group the report into an issue
+	issue, err := recordIssue(report, packet.Message, packet.Culprit, inAppFrames(lo), dropped != "")
+	if err != nil {
+		return "", err
+	}
+	report.IssueID = issue.ID
+
+	// Retries get the same answer even if the report isn't stored
+	if dropped != "" {
+		rememberKey(report)
+		return dropped, nil
+	}
+	packet.AddTags(map[string]string{
+		"issue": issue.ID,
+	})
+
+	// Store the report using the event ID as the key
+	packet.EventID = report.ID
+	if err := r.DB(*rethinkdbDatabase).Table("reports").Insert(report).Exec(session); err != nil {
+		return "", err
+	}
+
+	// Send the packet to the sinks, retrying from the spool if it fails
+	packet.Timestamp = raven.Timestamp(report.ReceivedAt)
+	if err := deliverPacket(packet); err != nil {
+		return "", err
+	}
+
+	// Failed reports are retried with the same key
+	rememberKey(report)
+
+	return "", nil
+}
+
+// GET /queue - depth of the ingestion queue and worker activity
+func showQueue(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"sync":         *syncMode,
+		"depth":        len(reportQueue),
+		"capacity":     cap(reportQueue),
+		"workers":      *workers,
+		"busy_workers": atomic.LoadInt64(&busyWorkers),
+		"processed":    atomic.LoadInt64(&processedReports),
+		"failed":       atomic.LoadInt64(&failedReports),
+	})
+}
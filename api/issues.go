@@ -0,0 +1,635 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/goji/web"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Actor used for state changes made by lavatrace itself
+const systemActor = "lavatrace"
+
+// Locks of the issues being updated, by ID or by fingerprint while looking
+// issues up. recordIssue replaces whole issues, so every other update of an
+// issue has to hold its lock.
+var (
+	issueLocks     = map[string]*issueLock{}
+	issueLocksLock sync.Mutex
+)
+
+type issueLock struct {
+	sync.Mutex
+	users int
+}
+
+// lockIssues locks the given keys in order so that concurrent callers can't
+// deadlock, and returns the function unlocking them.
+func lockIssues(keys ...string) func() {
+	keys = append([]string{}, keys...)
+	sort.Strings(keys)
+
+	issueLocksLock.Lock()
+	locked := []string{}
+	locks := []*issueLock{}
+	for i, key := range keys {
+		if i > 0 && key == keys[i-1] {
+			continue
+		}
+		lock, ok := issueLocks[key]
+		if !ok {
+			lock = &issueLock{}
+			issueLocks[key] = lock
+		}
+		lock.users++
+		locked = append(locked, key)
+		locks = append(locks, lock)
+	}
+	issueLocksLock.Unlock()
+
+	for _, lock := range locks {
+		lock.Lock()
+	}
+
+	return func() {
+		issueLocksLock.Lock()
+		defer issueLocksLock.Unlock()
+
+		for i, lock := range locks {
+			lock.Unlock()
+			lock.users--
+			if lock.users == 0 {
+				delete(issueLocks, locked[i])
+			}
+		}
+	}
+}
+
+// fingerprintLock is the lock key of the issue lookups of a fingerprint.
+func fingerprintLock(fp string) string {
+	return "fingerprint:" + fp
+}
+
+// fingerprint computes the grouping key of a symbolicated log. It's based
+// on the last entry's normalized message and its grouping frames (see
+// applyGroupingRules).
+func fingerprint(lo *models.Log) string {
+	hash := sha1.New()
+
+	if len(lo.Entries) > 0 {
+		entry := lo.Entries[len(lo.Entries)-1]
+		io.WriteString(hash, normalizeMessage(entry.Message))
+
+		for _, frame := range entry.Frames {
+			if !frame.Group {
+				continue
+			}
+
+			io.WriteString(hash, "\n"+frame.Filename+":"+frame.Name)
+		}
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// inAppFrames lists the in-app frames of the log's last entry as
+// "filename:name" strings.
+func inAppFrames(lo *models.Log) []string {
+	frames := []string{}
+	if len(lo.Entries) == 0 {
+		return frames
+	}
+
+	for _, frame := range lo.Entries[len(lo.Entries)-1].Frames {
+		if !frame.InApp {
+			continue
+		}
+
+		frames = append(frames, frame.Filename+":"+frame.Name)
+	}
+
+	return frames
+}
+
+// recordIssue groups a report into an issue, creating it if it doesn't exist
+// yet and applying the lifecycle rules (regressions, ignore expiry). Dropped
+// reports are counted but don't update the issue's details.
+func recordIssue(report *models.Report, message, culprit string, frames []string, dropped bool) (*models.Issue, error) {
+	// Concurrent first events must not create duplicate issues
+	defer lockIssues(fingerprintLock(report.Fingerprint))()
+
+	now := time.Now()
+
+	for {
+		cursor, err := r.DB(*rethinkdbDatabase).Table("issues").GetAllByIndex("fingerprints", report.Fingerprint).Run(session)
+		if err != nil {
+			return nil, err
+		}
+		var result []*models.Issue
+		if err := cursor.All(&result); err != nil {
+			return nil, err
+		}
+		if len(result) == 0 {
+			break
+		}
+
+		unlock := lockIssues(result[0].ID)
+		issue, err := getIssue(result[0].ID)
+		if err == r.ErrEmptyResult || (err == nil && !containsString(issue.Fingerprints, report.Fingerprint)) {
+			// Merged or unmerged before we got the lock
+			unlock()
+			continue
+		}
+		if err == nil {
+			err = updateIssue(issue, report, message, culprit, frames, dropped, now)
+		}
+		unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		return issue, nil
+	}
+
+	// First event of the issue
+	issue := &models.Issue{
+		ID:          uniuri.NewLen(uniuri.UUIDLen),
+		Fingerprint: report.Fingerprint,
+		Message:     message,
+		Culprit:     culprit,
+		Count:       1,
+		FirstSeen:   now,
+		LastSeen:    now,
+		FirstCommit: report.CommitID,
+		LastCommit:  report.CommitID,
+		LastVersion: report.Version,
+		Status:      models.IssueUnresolved,
+
+		Fingerprints: []string{report.Fingerprint},
+		Frames:       frames,
+	}
+
+	if dropped {
+		issue.Dropped = 1
+		issue.DroppedFingerprints = map[string]int{
+			report.Fingerprint: 1,
+		}
+	}
+
+	if err := r.DB(*rethinkdbDatabase).Table("issues").Insert(issue).Exec(session); err != nil {
+		return nil, err
+	}
+
+	return issue, nil
+}
+
+// updateIssue counts a new event of a locked issue.
+func updateIssue(issue *models.Issue, report *models.Report, message, culprit string, frames []string, dropped bool, now time.Time) error {
+	issue.Count++
+	issue.LastSeen = now
+	issue.LastCommit = report.CommitID
+	if report.Version != "" {
+		issue.LastVersion = report.Version
+	}
+	if dropped {
+		issue.Dropped++
+		if issue.DroppedFingerprints == nil {
+			issue.DroppedFingerprints = map[string]int{}
+		}
+		issue.DroppedFingerprints[report.Fingerprint]++
+	} else {
+		issue.Message = message
+		issue.Culprit = culprit
+		issue.Frames = frames
+	}
+
+	var activity *models.Activity
+	switch issue.Status {
+	case models.IssueResolved:
+		if regresses(issue, report) {
+			issue.Status = models.IssueRegressed
+			activity = &models.Activity{
+				Type: models.ActivityRegressed,
+				Data: map[string]interface{}{
+					"commit":  report.CommitID,
+					"version": report.Version,
+				},
+			}
+		}
+	case models.IssueIgnored:
+		if (issue.IgnoreCount > 0 && issue.Count-issue.IgnoreBase >= issue.IgnoreCount) ||
+			(!issue.IgnoreUntil.IsZero() && now.After(issue.IgnoreUntil)) {
+			issue.Status = models.IssueUnresolved
+			activity = &models.Activity{
+				Type: models.ActivityUnresolved,
+			}
+		}
+	}
+
+	if err := r.DB(*rethinkdbDatabase).Table("issues").Get(issue.ID).Replace(issue).Exec(session); err != nil {
+		return err
+	}
+
+	if activity != nil {
+		activity.IssueID = issue.ID
+		activity.Actor = systemActor
+		return insertActivity(activity)
+	}
+
+	return nil
+}
+
+// regresses checks whether a report for a resolved issue should reopen it.
+// Only issues resolved in the next release regress, on events of a newer
+// version, or of another commit for apps that don't report versions.
+func regresses(issue *models.Issue, report *models.Report) bool {
+	if issue.ResolvedVersion != "" && report.Version != "" {
+		return compareVersions(report.Version, issue.ResolvedVersion) > 0
+	}
+
+	if issue.ResolvedCommit != "" {
+		return report.CommitID != issue.ResolvedCommit
+	}
+
+	return false
+}
+
+// compareVersions compares two dot-separated versions, numerically where
+// possible. Pre-releases rank below their release like in semver, so that
+// 1.0.0-beta < 1.0.0. It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	split := func(v string) (string, string) {
+		v = strings.TrimPrefix(v, "v")
+		if i := strings.Index(v, "+"); i != -1 {
+			v = v[:i]
+		}
+		if i := strings.Index(v, "-"); i != -1 {
+			return v[:i], v[i+1:]
+		}
+		return v, ""
+	}
+
+	ar, apre := split(a)
+	br, bpre := split(b)
+
+	// Missing parts count as zeroes so that 1.0 == 1.0.0
+	if c := compareIdentifiers(strings.Split(ar, "."), strings.Split(br, "."), "0"); c != 0 {
+		return c
+	}
+
+	switch {
+	case apre == bpre:
+		return 0
+	case apre == "":
+		return 1
+	case bpre == "":
+		return -1
+	}
+
+	// A larger set of pre-release fields has a higher precedence
+	return compareIdentifiers(strings.Split(apre, "."), strings.Split(bpre, "."), "")
+}
+
+// compareIdentifiers compares version parts one by one, numeric ones below
+// the alphanumeric ones. Missing parts are replaced with the padding, or
+// rank lower if it's empty.
+func compareIdentifiers(ap, bp []string, padding string) int {
+	for i := 0; i < len(ap) || i < len(bp); i++ {
+		x, y := padding, padding
+		if i < len(ap) {
+			x = ap[i]
+		}
+		if i < len(bp) {
+			y = bp[i]
+		}
+		if x == y {
+			continue
+		}
+		if x == "" {
+			return -1
+		}
+		if y == "" {
+			return 1
+		}
+
+		xi, xerr := strconv.Atoi(x)
+		yi, yerr := strconv.Atoi(y)
+		switch {
+		case xerr == nil && yerr == nil:
+			if xi != yi {
+				if xi < yi {
+					return -1
+				}
+				return 1
+			}
+		case xerr == nil:
+			return -1
+		case yerr == nil:
+			return 1
+		case x < y:
+			return -1
+		default:
+			return 1
+		}
+	}
+
+	return 0
+}
+
+func insertActivity(activity *models.Activity) error {
+	if activity.ID == "" {
+		activity.ID = uniuri.NewLen(uniuri.UUIDLen)
+	}
+	if activity.Date.IsZero() {
+		activity.Date = time.Now()
+	}
+	if activity.Actor == "" {
+		activity.Actor = "admin"
+	}
+
+	return r.DB(*rethinkdbDatabase).Table("activities").Insert(activity).Exec(session)
+}
+
+func getIssue(id string) (*models.Issue, error) {
+	cursor, err := r.DB(*rethinkdbDatabase).Table("issues").Get(id).Run(session)
+	if err != nil {
+		return nil, err
+	}
+	var issue *models.Issue
+	if err := cursor.One(&issue); err != nil {
+		return nil, err
+	}
+
+	return issue, nil
+}
+
+// loadIssue fetches the issue from the URL params, writing an error response
+// if it can't be found.
+func loadIssue(c web.C, w http.ResponseWriter) (*models.Issue, bool) {
+	issue, err := getIssue(c.URLParams["id"])
+	if err != nil {
+		if err == r.ErrEmptyResult {
+			w.WriteHeader(404)
+			w.Write([]byte("Issue not found"))
+			return nil, false
+		}
+
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return nil, false
+	}
+
+	return issue, true
+}
+
+// updateIssueStatus stores the issue and records the change in its activity log.
+func updateIssueStatus(w http.ResponseWriter, issue *models.Issue, activity *models.Activity) {
+	if err := r.DB(*rethinkdbDatabase).Table("issues").Get(issue.ID).Replace(issue).Exec(session); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	activity.IssueID = issue.ID
+	if err := insertActivity(activity); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, issue)
+}
+
+// decodeOptional decodes an optional JSON request body.
+func decodeOptional(req *http.Request, v interface{}) error {
+	if err := json.NewDecoder(req.Body).Decode(v); err != nil && err != io.EOF {
+		return err
+	}
+
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	json.NewEncoder(w).Encode(v)
+}
+
+// httpError is an error that should be reported with a specific status code.
+type httpError struct {
+	Code    int
+	Message string
+}
+
+func (e *httpError) Error() string { return e.Message }
+
+func badRequest(message string) error {
+	return &httpError{
+		Code:    400,
+		Message: message,
+	}
+}
+
+// writeError writes an error response, using a 500 unless the error
+// specifies another status code.
+func writeError(w http.ResponseWriter, err error) {
+	switch err := err.(type) {
+	case *validationError:
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(400)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"message": "Invalid report",
+			"errors":  err.Errors,
+		})
+		return
+	case *httpError:
+		w.WriteHeader(err.Code)
+	default:
+		w.WriteHeader(500)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+// GET /issues - lists issues, optionally filtered by ?status=
+func listIssues(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	query := r.DB(*rethinkdbDatabase).Table("issues")
+	if status := req.URL.Query().Get("status"); status != "" {
+		query = query.Filter(map[string]interface{}{
+			"status": status,
+		})
+	}
+
+	cursor, err := query.OrderBy(r.Desc("last_seen")).Run(session)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	result := []*models.Issue{}
+	if err := cursor.All(&result); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	writeJSON(w, result)
+}
+
+// GET /issues/:id
+func showIssue(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	writeJSON(w, issue)
+}
+
+// POST /issues/:id/resolve - {"actor": "", "in_next_release": false}
+func resolveIssue(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor         string `json:"actor"`
+		InNextRelease bool   `json:"in_next_release"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// recordIssue replaces whole issues
+	defer lockIssues(c.URLParams["id"])()
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	issue.Status = models.IssueResolved
+	issue.ResolvedAt = time.Now()
+	issue.ResolvedVersion = ""
+	issue.ResolvedCommit = ""
+	if input.InNextRelease {
+		// Events of the release that's currently out don't count
+		issue.ResolvedVersion = issue.LastVersion
+		issue.ResolvedCommit = issue.LastCommit
+	}
+
+	updateIssueStatus(w, issue, &models.Activity{
+		Type:  models.ActivityResolved,
+		Actor: input.Actor,
+		Data: map[string]interface{}{
+			"in_next_release": input.InNextRelease,
+		},
+	})
+}
+
+// POST /issues/:id/ignore - {"actor": "", "count": 0, "until": "RFC3339 date"}
+func ignoreIssue(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor string    `json:"actor"`
+		Count int       `json:"count"`
+		Until time.Time `json:"until"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if input.Count < 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("Invalid count"))
+		return
+	}
+
+	// recordIssue replaces whole issues
+	defer lockIssues(c.URLParams["id"])()
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	issue.Status = models.IssueIgnored
+	issue.IgnoreCount = input.Count
+	issue.IgnoreBase = issue.Count
+	issue.IgnoreUntil = input.Until
+
+	data := map[string]interface{}{}
+	if input.Count > 0 {
+		data["count"] = input.Count
+	}
+	if !input.Until.IsZero() {
+		data["until"] = input.Until
+	}
+
+	updateIssueStatus(w, issue, &models.Activity{
+		Type:  models.ActivityIgnored,
+		Actor: input.Actor,
+		Data:  data,
+	})
+}
+
+// POST /issues/:id/unresolve - {"actor": ""}
+func unresolveIssue(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor string `json:"actor"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// recordIssue replaces whole issues
+	defer lockIssues(c.URLParams["id"])()
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	issue.Status = models.IssueUnresolved
+	issue.ResolvedAt = time.Time{}
+	issue.ResolvedVersion = ""
+	issue.ResolvedCommit = ""
+	issue.IgnoreCount = 0
+	issue.IgnoreBase = 0
+	issue.IgnoreUntil = time.Time{}
+
+	updateIssueStatus(w, issue, &models.Activity{
+		Type:  models.ActivityUnresolved,
+		Actor: input.Actor,
+	})
+}
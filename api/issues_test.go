@@ -0,0 +1,99 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0.0", "1.0.0", 0},
+		{"1.0", "1.0.0", 0},
+		{"v1.2.0", "1.2.0", 0},
+		{"1.0.0+build.1", "1.0.0+build.2", 0},
+		{"1.2.0", "1.10.0", -1},
+		{"2.0.0", "1.99.99", 1},
+		{"1.0.1", "1.0", 1},
+		{"1.0.0-beta", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc.1", 1},
+		{"1.0.0-alpha", "1.0.0-alpha.1", -1},
+		{"1.0.0-alpha.1", "1.0.0-alpha.beta", -1},
+		{"1.0.0-beta.2", "1.0.0-beta.11", -1},
+		{"1.0.0-rc.1", "1.0.0-beta.11", 1},
+		{"1.0.0-beta", "0.9.0", 1},
+	}
+
+	for _, test := range tests {
+		if result := compareVersions(test.a, test.b); result != test.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", test.a, test.b, result, test.expected)
+		}
+		if result := compareVersions(test.b, test.a); result != -test.expected {
+			t.Errorf("compareVersions(%q, %q) = %d, expected %d", test.b, test.a, result, -test.expected)
+		}
+	}
+}
+
+func TestRegresses(t *testing.T) {
+	tests := []struct {
+		resolvedVersion, resolvedCommit string
+		version, commit                 string
+		expected                        bool
+	}{
+		// Resolved without a release
+		{"", "", "2.0.0", "def", false},
+		{"", "", "", "def", false},
+
+		// Resolved in the next release
+		{"1.0.0", "abc", "1.0.0", "def", false},
+		{"1.0.0", "abc", "1.0.0-rc.1", "def", false},
+		{"1.0.0", "abc", "1.0.1", "def", true},
+		{"1.0.0", "abc", "", "abc", false},
+		{"1.0.0", "abc", "", "def", true},
+		{"", "abc", "", "abc", false},
+		{"", "abc", "", "def", true},
+	}
+
+	for _, test := range tests {
+		issue := &models.Issue{
+			Status:          models.IssueResolved,
+			ResolvedVersion: test.resolvedVersion,
+			ResolvedCommit:  test.resolvedCommit,
+		}
+		report := &models.Report{
+			Version:  test.version,
+			CommitID: test.commit,
+		}
+		if result := regresses(issue, report); result != test.expected {
+			t.Errorf("Issue resolved in %q/%q regresses on %q/%q: %v, expected %v",
+				test.resolvedVersion, test.resolvedCommit, test.version, test.commit, result, test.expected)
+		}
+	}
+}
+
+func TestLockIssues(t *testing.T) {
+	unlock := lockIssues("b", "a", "b")
+	done := make(chan bool)
+	go func() {
+		lockIssues("a")()
+		done <- true
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Acquired a held lock")
+	default:
+	}
+
+	unlock()
+	<-done
+
+	issueLocksLock.Lock()
+	defer issueLocksLock.Unlock()
+	if len(issueLocks) != 0 {
+		t.Errorf("Unused locks weren't released: %v", issueLocks)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/lavab/raven-go"
+)
+
+// Severities ordered from the least to the most severe
+var severityOrder = map[raven.Severity]int{
+	raven.DEBUG:   0,
+	raven.INFO:    1,
+	raven.WARNING: 2,
+	raven.ERROR:   3,
+	raven.FATAL:   4,
+}
+
+// entryLevels maps entry types (console methods) to severities. Unknown types
+// are treated as info.
+var entryLevels = map[string]raven.Severity{
+	"trace":  raven.DEBUG,
+	"debug":  raven.DEBUG,
+	"log":    raven.INFO,
+	"info":   raven.INFO,
+	"warn":   raven.WARNING,
+	"error":  raven.ERROR,
+	"assert": raven.ERROR,
+	"fatal":  raven.FATAL,
+}
+
+// Reports less severe than this are dropped, if it's set
+var minLevel raven.Severity
+
+func parseSeverity(input string) (raven.Severity, error) {
+	severity := raven.Severity(strings.ToLower(strings.TrimSpace(input)))
+	if _, ok := severityOrder[severity]; !ok {
+		return "", errors.New("Invalid severity " + input)
+	}
+
+	return severity, nil
+}
+
+// parseEntryLevels merges a "type=severity,type=severity" list into the
+// entry level mapping.
+func parseEntryLevels(input string) error {
+	for _, pair := range strings.Split(input, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("Invalid entry level " + pair)
+		}
+
+		severity, err := parseSeverity(parts[1])
+		if err != nil {
+			return err
+		}
+
+		entryLevels[strings.TrimSpace(parts[0])] = severity
+	}
+
+	return nil
+}
+
+func entryLevel(kind string) raven.Severity {
+	if severity, ok := entryLevels[kind]; ok {
+		return severity
+	}
+
+	return raven.INFO
+}
+
+// mostSevere returns the most severe level of the given entry types.
+func mostSevere(kinds []string) raven.Severity {
+	if len(kinds) == 0 {
+		return raven.ERROR
+	}
+
+	result := raven.DEBUG
+	for _, kind := range kinds {
+		if level := entryLevel(kind); severityOrder[level] > severityOrder[result] {
+			result = level
+		}
+	}
+
+	return result
+}
+
+// belowMinLevel checks whether a report of that level should be dropped.
+func belowMinLevel(level raven.Severity) bool {
+	return minLevel != "" && severityOrder[level] < severityOrder[minLevel]
+}
@@ -1,36 +1,68 @@
 package main
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"io/ioutil"
 	"log"
 	"net/http"
-	"path"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	r "github.com/dancannon/gorethink"
 	"github.com/dchest/uniuri"
 	"github.com/lavab/goji"
 	"github.com/lavab/goji/web"
-	"github.com/lavab/raven-go"
 	"github.com/namsral/flag"
 	"github.com/neelance/sourcemap"
-
-	"github.com/lavab/lavatrace/models"
 )
 
 var (
-	configFlag        = flag.String("config", "", "config file to load")
-	rethinkdbAddress  = flag.String("rethinkdb_address", "127.0.0.1:28015", "RethinkDB address")
-	rethinkdbDatabase = flag.String("rethinkdb_database", "lavatrace", "Name of the RethinkDB database to use")
-	adminToken        = flag.String("admin_token", uniuri.NewLen(uniuri.UUIDLen), "Admin token for source map uploads")
-	ravenDSN          = flag.String("raven_dsn", "", "Raven DSN")
+	configFlag          = flag.String("config", "", "config file to load")
+	rethinkdbAddress    = flag.String("rethinkdb_address", "127.0.0.1:28015", "RethinkDB address")
+	rethinkdbDatabase   = flag.String("rethinkdb_database", "lavatrace", "Name of the RethinkDB database to use")
+	adminToken          = flag.String("admin_token", uniuri.NewLen(uniuri.UUIDLen), "Admin token for source map uploads")
+	ravenDSN            = flag.String("raven_dsn", "", "Raven DSN")
+	sinksFile           = flag.String("sinks", "", "Path to a JSON file listing the output sinks, defaults to Sentry if raven_dsn is set")
+	groupingRulesFile   = flag.String("grouping_rules", "", "Path to a file with stack-trace grouping rules")
+	reactErrorCodesFile = flag.String("react_error_codes", "", "Path to React's codes.json, merged into the bundled error codes")
+	entryLevelsFlag     = flag.String("entry_levels", "", "Entry type to severity mapping overrides, eg. log=debug,warn=error")
+	minLevelFlag        = flag.String("min_level", "", "Drop reports less severe than this level (debug, info, warning, error, fatal)")
+	maxReportSize       = flag.Int("max_report_size", 1<<20, "Maximal size of a report body in bytes")
+	maxEntries          = flag.Int("max_entries", 100, "Maximal number of entries in a report")
+	maxFrames           = flag.Int("max_frames", 256, "Maximal number of frames in a stacktrace")
+	maxAssets           = flag.Int("max_assets", 100, "Maximal number of assets in a report")
+	maxObjects          = flag.Int("max_objects", 32, "Maximal number of objects in an entry")
+	maxObjectSize       = flag.Int("max_object_size", 64<<10, "Maximal size of an entry's JSON-encoded objects in bytes")
+	maxMessageLength    = flag.Int("max_message_length", 8192, "Maximal length of an entry's message")
+	maxObjectDepth      = flag.Int("max_object_depth", 5, "Objects nested deeper than this are truncated")
+	maxObjectBreadth    = flag.Int("max_object_breadth", 50, "Arrays and objects with more items than this are truncated")
+	maxObjectString     = flag.Int("max_object_string", 1024, "Strings in objects longer than this are truncated")
+	scrubDetectorsFlag  = flag.String("scrub_detectors", "url_secret,bearer,jwt,email,credit_card", "Built-in PII detectors to apply to reports")
+	scrubKeysFlag       = flag.String("scrub_keys", "password,passwd,secret,token,api_key,apikey,auth,cookie,session,card_number,cvv", "Object keys whose values are always scrubbed")
+	scrubRulesFile      = flag.String("scrub_rules", "", "Path to a file with custom PII patterns")
+	sampleRate          = flag.Float64("sample_rate", 1, "Fraction of the reports to store and send to the sinks")
+	samplingRulesFile   = flag.String("sampling_rules", "", "Path to a file with per-version and per-message sample rates")
+	maxEventsPerMinute  = flag.Int("max_events_per_minute", 0, "Maximal number of events per fingerprint and minute, 0 for no limit")
+	dedupeWindowFlag    = flag.Duration("dedupe_window", time.Minute, "Identical reports within this window only count as repeats of the first one, 0 to disable")
+	idempotencyTTL      = flag.Duration("idempotency_ttl", 24*time.Hour, "How long report IDs and idempotency keys are remembered")
+	workers             = flag.Int("workers", 4, "Number of workers processing the queued reports")
+	queueSize           = flag.Int("queue_size", 1000, "Maximal number of queued reports")
+	syncMode            = flag.Bool("sync", false, "Process reports before answering, for debugging")
+	spoolDir            = flag.String("spool_dir", "spool", "Directory of the spool of undelivered events, empty to disable")
+	spoolMaxAge         = flag.Duration("spool_max_age", 24*time.Hour, "Spooled events older than this are dropped")
+	deliveryTimeout     = flag.Duration("delivery_timeout", 10*time.Second, "Default timeout of event deliveries, overridden by the timeout of a sink")
+	breakerThreshold    = flag.Int("breaker_threshold", 5, "Consecutive delivery failures opening a destination's circuit breaker")
+	breakerCooldown     = flag.Duration("breaker_cooldown", 30*time.Second, "Time before an open circuit breaker lets a probe through")
 )
 
 var (
-	session *r.Session
+	session     *r.Session
+	tokenHeader string
 )
 
 type Map struct {
@@ -64,12 +96,117 @@ func main() {
 	}).Exec(session)
 	r.DB(*rethinkdbDatabase).TableCreate("reports").Exec(session)
 	r.DB(*rethinkdbDatabase).Table("reports").IndexCreate("version").Exec(session)
+	r.DB(*rethinkdbDatabase).Table("reports").IndexCreate("issue_id").Exec(session)
+	r.DB(*rethinkdbDatabase).TableCreate("report_keys").Exec(session)
+	r.DB(*rethinkdbDatabase).Table("report_keys").IndexCreate("date").Exec(session)
+	r.DB(*rethinkdbDatabase).TableCreate("issues").Exec(session)
+	r.DB(*rethinkdbDatabase).Table("issues").IndexCreate("fingerprints", r.IndexCreateOpts{
+		Multi: true,
+	}).Exec(session)
+	r.DB(*rethinkdbDatabase).TableCreate("activities").Exec(session)
+	r.DB(*rethinkdbDatabase).Table("activities").IndexCreate("issue_id").Exec(session)
+	r.DB(*rethinkdbDatabase).TableCreate("comments").Exec(session)
+	r.DB(*rethinkdbDatabase).Table("comments").IndexCreate("issue_id").Exec(session)
+	r.DB(*rethinkdbDatabase).TableCreate("links").Exec(session)
+	r.DB(*rethinkdbDatabase).Table("links").IndexCreate("issue_id").Exec(session)
+	r.DB(*rethinkdbDatabase).TableCreate("filters").Exec(session)
+
+	// Load the grouping rules
+	if *groupingRulesFile != "" {
+		data, err := ioutil.ReadFile(*groupingRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
 
-	// Connect to Raven
-	rc, err := raven.NewClient(*ravenDSN, nil)
-	if err != nil {
+		groupingRules, err = parseGroupingRules(string(data))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Load the React error codes
+	if *reactErrorCodesFile != "" {
+		if err := loadReactErrorCodes(*reactErrorCodesFile); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Set up the severity levels
+	if err := parseEntryLevels(*entryLevelsFlag); err != nil {
 		log.Fatal(err)
 	}
+	if *minLevelFlag != "" {
+		minLevel, err = parseSeverity(*minLevelFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Create the default inbound filters, keeping the existing ones as they
+	// might have been edited
+	for _, filter := range defaultFilters {
+		filter.Date = time.Now()
+	}
+	r.DB(*rethinkdbDatabase).Table("filters").Insert(defaultFilters).Exec(session)
+	if err := loadFilters(); err != nil {
+		log.Fatal(err)
+	}
+
+	// Load the sampling rules
+	if *sampleRate < 0 || *sampleRate > 1 {
+		log.Fatal("sample_rate must be between 0 and 1")
+	}
+	if *samplingRulesFile != "" {
+		data, err := ioutil.ReadFile(*samplingRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		samplingRules, err = parseSamplingRules(string(data))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Set up the PII scrubbing
+	customDetectors := []*scrubDetector{}
+	if *scrubRulesFile != "" {
+		data, err := ioutil.ReadFile(*scrubRulesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		customDetectors, err = parseScrubRules(string(data))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := setupScrubbers(*scrubDetectorsFlag, *scrubKeysFlag, customDetectors); err != nil {
+		log.Fatal(err)
+	}
+
+	// Build the report schemas using the configured limits
+	reportSchemas = buildReportSchemas()
+
+	// Set up the output sinks
+	if err := loadSinks(*sinksFile); err != nil {
+		log.Fatal(err)
+	}
+
+	// Resume the deliveries interrupted by a restart
+	if *spoolDir != "" {
+		if err := openSpool(); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Start processing the reports
+	if !*syncMode {
+		startWorkers()
+	}
+
+	// Forget the expired idempotency keys
+	go expireReportKeys()
 
 	// Index page
 	goji.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -77,13 +214,11 @@ func main() {
 	})
 
 	// Map uploading header (alloc it here so that it won't be alloc'd in each request)
-	tokenHeader := "Bearer " + *adminToken
+	tokenHeader = "Bearer " + *adminToken
 
 	goji.Post("/maps/:commit", func(c web.C, w http.ResponseWriter, req *http.Request) {
 		// Check if the token is valid
-		if header := req.Header.Get("Authorization"); header == "" || header != tokenHeader {
-			w.WriteHeader(403)
-			w.Write([]byte("Invalid authorization token"))
+		if !checkToken(w, req) {
 			return
 		}
 
@@ -124,158 +259,176 @@ func main() {
 
 	// Report - registers a new event
 	goji.Post("/report", func(w http.ResponseWriter, req *http.Request) {
-		// Parse the request body
-		var report *models.Report
-		if err := json.NewDecoder(req.Body).Decode(&report); err != nil {
-			w.WriteHeader(400)
-			w.Write([]byte(err.Error()))
+		// Parse and validate the request body
+		report, err := decodeReport(w, req)
+		if err != nil {
+			writeError(w, err)
 			return
 		}
 
-		// Prepare a new packet
-		packet := &raven.Packet{
-			Interfaces: []raven.Interface{},
-			Platform:   "javascript",
-			Release:    report.CommitID,
+		readClientContext(report, req)
+
+		// Return the original event of retried submissions
+		key := idempotencyKey(report, req)
+		if key != "" {
+			eid, found, err := findReportByKey(key)
+			if err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+			if found {
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.Write([]byte(eid))
+				return
+			}
 		}
 
-		lo := &models.Log{
-			CommitID: report.CommitID,
-			Version:  report.Version,
-			Assets:   report.Assets,
-			Entries:  []*models.LogEntry{},
+		// Drop the noise before doing any work
+		if filter, ok := filterReport(report); ok {
+			w.WriteHeader(202)
+			w.Write([]byte("Filtered by " + filter.ID))
+			return
 		}
 
-		// Transform entries into exceptions
+		// Drop reports below the minimum level before doing any work
+		kinds := []string{}
 		for _, entry := range report.Entries {
-			// Prepare a new Entry
-			en := &models.LogEntry{
-				Date:    entry.Date,
-				Type:    entry.Type,
-				Message: entry.Message,
-				Objects: entry.Objects,
-				Frames:  []*models.LogFrame{},
+			kinds = append(kinds, entry.Type)
+		}
+		if belowMinLevel(mostSevere(kinds)) {
+			w.WriteHeader(202)
+			w.Write([]byte("Dropped"))
+			return
+		}
+
+		// Redact PII before anything gets stored or sent
+		report.Scrubbed = scrubReport(report)
+
+		job := &reportJob{
+			Report:  report,
+			Request: newRequestInterface(report, req),
+			Hash:    contentHash(report),
+		}
+
+		// The event ID is known before the report gets processed
+		report.ID = newEventID()
+		report.ReceivedAt = time.Now()
+
+		// Repeats of a recent report are only counted
+		if window, ok := reserveReport(job.Hash, report.ID); !ok {
+			if !*syncMode {
+				w.WriteHeader(202)
+				w.Write([]byte(window.ReportID))
+				return
 			}
 
-			// Stacktrace is a string with format:
-			//   fileIndex:line:column
-			for _, part := range strings.Split(entry.Stacktrace, ";") {
-				// Parse each call
-				call := strings.Split(part, ":")
-				if len(call) < 3 {
-					w.WriteHeader(400)
-					w.Write([]byte("Invalid stacktrace"))
-					return
-				}
-
-				// Integer parsing helper
-				err = nil
-				mustParse := func(input string) int {
-					if err == nil {
-						x, e := strconv.Atoi(input)
-						if e != nil {
-							err = e
-							return 0
-						}
-
-						return x
-					}
-
-					return 0
-				}
-
-				// Parse the fields
-				var (
-					fileIndex = call[0]
-					lineNo    = mustParse(call[1])
-					columnNo  = mustParse(call[2])
-				)
-
-				// First case - we don't know the source
-				switch fileIndex {
-				case "/":
-					en.Frames = append(en.Frames, &models.LogFrame{
-						Filename: "unknown",
-						Name:     "unknown",
-						LineNo:   lineNo,
-						ColNo:    columnNo,
-						InApp:    true,
-					})
-				case "native":
-					en.Frames = append(en.Frames, &models.LogFrame{
-						Filename: "native",
-						Name:     "native",
-						LineNo:   lineNo,
-						ColNo:    columnNo,
-						InApp:    false,
-					})
-				default:
-					// Convert file index to an int
-					fii, err := strconv.Atoi(fileIndex)
-					if err != nil {
-						w.WriteHeader(400)
-						w.Write([]byte(err.Error()))
-						return
-					}
-
-					// Map index to file path
-					if len(report.Assets) < fii+1 {
-						w.WriteHeader(400)
-						w.Write([]byte("Invalid asset ID"))
-						return
-					}
-					asset := report.Assets[fii]
-
-					// Get the asset's filename
-					filename := path.Base(asset) + ".map"
-
-					// Map the data
-					mapping, err := getMapping(report.CommitID, filename, lineNo, columnNo)
-					if err != nil {
-						w.WriteHeader(500)
-						w.Write([]byte(err.Error()))
-						return
-					}
-
-					// Append it to the stacktrace
-					en.Frames = append(en.Frames, &models.LogFrame{
-						Filename: mapping.OriginalFile,
-						Name:     mapping.OriginalName,
-						LineNo:   mapping.OriginalLine,
-						ColNo:    mapping.OriginalColumn,
-						InApp:    true,
-						AbsPath:  asset,
-					})
-				}
+			// Like the first report, wait until it's processed
+			dropped, err := window.wait()
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if dropped != "" {
+				w.WriteHeader(202)
+				w.Write([]byte("Dropped (" + dropped + ")"))
+				return
 			}
 
-			// Put entry into entries
-			lo.Entries = append(lo.Entries, en)
+			w.Write([]byte(window.ReportID))
+			return
 		}
 
-		// Append the Log to interfaces
-		packet.Interfaces = append(packet.Interfaces, lo)
+		if key != "" {
+			if eid, ok := lockKey(key, report.ID); !ok {
+				releaseReport(job.Hash, report.ID, errReportReleased)
+				w.Header().Set("Idempotent-Replayed", "true")
+				w.WriteHeader(202)
+				w.Write([]byte(eid))
+				return
+			}
+			report.ReportID = key
+		}
 
-		// Set the culprit and message
-		lastEntry := lo.Entries[len(lo.Entries)-1]
-		lastFrame := lastEntry.Frames[len(lastEntry.Frames)-1]
+		// Synchronous mode reports the errors of the whole pipeline
+		if *syncMode {
+			dropped, err := processReport(job)
+			if err != nil {
+				writeError(w, err)
+				return
+			}
+			if dropped != "" {
+				w.WriteHeader(202)
+				w.Write([]byte("Dropped (" + dropped + ")"))
+				return
+			}
+
+			w.Write([]byte(report.ID))
+			return
+		}
 
-		packet.Culprit = lastFrame.Name + "@" + strconv.Itoa(lastFrame.LineNo) + ":" + strconv.Itoa(lastFrame.ColNo)
-		packet.Message = lastEntry.Message
+		if !enqueueReport(job) {
+			if key != "" {
+				unlockKey(key)
+			}
+			releaseReport(job.Hash, report.ID, errReportReleased)
 
-		// Send the packet to Sentry
-		eid, ch := rc.Capture(packet, nil)
-		err = <-ch
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(503)
+			w.Write([]byte("Report queue is full"))
 			return
 		}
 
-		w.Write([]byte(eid))
+		w.WriteHeader(202)
+		w.Write([]byte(report.ID))
 		return
 	})
 
+	// Report schemas
+	goji.Get("/schema", listSchemas)
+	goji.Get("/schema/:version", showSchema)
+
+	// Ingestion queue
+	goji.Get("/queue", showQueue)
+
+	// Delivery status
+	goji.Get("/status", showStatus)
+
+	// Delivery spool
+	goji.Get("/spool", listSpool)
+	goji.Delete("/spool", purgeSpool)
+	goji.Delete("/spool/:id", deleteSpoolEntry)
+
+	// Sampling
+	goji.Get("/sampling", showSampling)
+
+	// Inbound filters
+	goji.Get("/filters", listFilters)
+	goji.Post("/filters", createFilter)
+	goji.Put("/filters/:id", updateFilter)
+	goji.Delete("/filters/:id", deleteFilter)
+
+	// Issues
+	goji.Get("/issues", listIssues)
+	goji.Get("/issues/:id", showIssue)
+	goji.Post("/issues/:id/resolve", resolveIssue)
+	goji.Post("/issues/:id/ignore", ignoreIssue)
+	goji.Post("/issues/:id/unresolve", unresolveIssue)
+	goji.Post("/issues/:id/assign", assignIssue)
+	goji.Get("/issues/:id/activity", listActivity)
+	goji.Get("/issues/:id/comments", listComments)
+	goji.Post("/issues/:id/comments", createComment)
+	goji.Delete("/issues/:id/comments/:comment", deleteComment)
+	goji.Get("/issues/:id/links", listLinks)
+	goji.Post("/issues/:id/links", createLink)
+	goji.Delete("/issues/:id/links/:link", deleteLink)
+	goji.Post("/issues/:id/merge", mergeIssues)
+	goji.Post("/issues/:id/unmerge", unmergeIssue)
+	goji.Get("/issues/:id/similar", similarIssues)
+
+	// Grouping
+	goji.Post("/grouping/test", testGrouping)
+
 	// Print out the current admin token
 	log.Printf("Current admin token is %s", *adminToken)
 
@@ -283,6 +436,24 @@ func main() {
 	goji.Serve()
 }
 
+// checkToken verifies the admin token, writing a 403 if it's invalid.
+func checkToken(w http.ResponseWriter, req *http.Request) bool {
+	if header := req.Header.Get("Authorization"); header == "" || header != tokenHeader {
+		w.WriteHeader(403)
+		w.Write([]byte("Invalid authorization token"))
+		return false
+	}
+
+	return true
+}
+
+// newEventID generates a Sentry-compatible event ID.
+func newEventID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
 var (
 	lineCache = map[string]*sourcemap.Mapping{}
 	lineLock  sync.RWMutex
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/dchest/uniuri"
+	"github.com/lavab/goji/web"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Tables whose rows are keyed by an issue ID and follow the issue on merges
+var issueTables = []string{"reports", "comments", "links", "activities"}
+
+// POST /issues/:id/merge - {"actor": "", "issues": ["id", ...]}, merges the
+// listed issues into the one from the URL
+func mergeIssues(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor  string   `json:"actor"`
+		Issues []string `json:"issues"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(input.Issues) == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("No issues to merge"))
+		return
+	}
+
+	defer lockIssues(append(input.Issues, c.URLParams["id"])...)()
+
+	target, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	// Load all the sources first so that we don't merge halfway
+	sources := []*models.Issue{}
+	loaded := map[string]bool{}
+	for _, id := range input.Issues {
+		if id == target.ID || loaded[id] {
+			continue
+		}
+		loaded[id] = true
+
+		source, err := getIssue(id)
+		if err != nil {
+			if err == r.ErrEmptyResult {
+				w.WriteHeader(404)
+				w.Write([]byte("Issue " + id + " not found"))
+				return
+			}
+
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		sources = append(sources, source)
+	}
+
+	merged := []string{}
+	for _, source := range sources {
+		// Move everything attached to the source
+		for _, table := range issueTables {
+			if err := r.DB(*rethinkdbDatabase).Table(table).GetAllByIndex("issue_id", source.ID).Update(map[string]interface{}{
+				"issue_id": target.ID,
+			}).Exec(session); err != nil {
+				w.WriteHeader(500)
+				w.Write([]byte(err.Error()))
+				return
+			}
+		}
+
+		if err := r.DB(*rethinkdbDatabase).Table("issues").Get(source.ID).Delete().Exec(session); err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		// Future events of the source's fingerprints land in the target
+		for _, fp := range source.Fingerprints {
+			if !containsString(target.Fingerprints, fp) {
+				target.Fingerprints = append(target.Fingerprints, fp)
+			}
+		}
+
+		target.Count += source.Count
+		target.Dropped += source.Dropped
+		for fp, dropped := range source.DroppedFingerprints {
+			if target.DroppedFingerprints == nil {
+				target.DroppedFingerprints = map[string]int{}
+			}
+			target.DroppedFingerprints[fp] += dropped
+		}
+		if source.FirstSeen.Before(target.FirstSeen) {
+			target.FirstSeen = source.FirstSeen
+			target.FirstCommit = source.FirstCommit
+		}
+		if source.LastSeen.After(target.LastSeen) {
+			target.LastSeen = source.LastSeen
+			target.LastCommit = source.LastCommit
+			target.LastVersion = source.LastVersion
+		}
+
+		merged = append(merged, source.ID)
+	}
+
+	updateIssueStatus(w, target, &models.Activity{
+		Type:  models.ActivityMerged,
+		Actor: input.Actor,
+		Data: map[string]interface{}{
+			"issues": merged,
+		},
+	})
+}
+
+// POST /issues/:id/unmerge - {"actor": "", "fingerprints": ["", ...]}, moves
+// the listed fingerprints and their reports out into a new issue
+func unmergeIssue(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	var input struct {
+		Actor        string   `json:"actor"`
+		Fingerprints []string `json:"fingerprints"`
+	}
+	if err := decodeOptional(req, &input); err != nil {
+		w.WriteHeader(400)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if len(input.Fingerprints) == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("No fingerprints to unmerge"))
+		return
+	}
+
+	// Events of the fingerprints wait for the new issue
+	keys := []string{}
+	for _, fp := range input.Fingerprints {
+		keys = append(keys, fingerprintLock(fp))
+	}
+	defer lockIssues(keys...)()
+	defer lockIssues(c.URLParams["id"])()
+
+	source, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	// Split the fingerprints
+	remaining := []string{}
+	for _, fp := range source.Fingerprints {
+		if !containsString(input.Fingerprints, fp) {
+			remaining = append(remaining, fp)
+		}
+	}
+	for _, fp := range input.Fingerprints {
+		if !containsString(source.Fingerprints, fp) {
+			w.WriteHeader(400)
+			w.Write([]byte("Fingerprint " + fp + " is not part of the issue"))
+			return
+		}
+	}
+	if len(remaining) == 0 {
+		w.WriteHeader(400)
+		w.Write([]byte("Can't unmerge every fingerprint of an issue"))
+		return
+	}
+
+	issue := &models.Issue{
+		ID:           uniuri.NewLen(uniuri.UUIDLen),
+		Fingerprint:  input.Fingerprints[0],
+		Fingerprints: input.Fingerprints,
+		Message:      source.Message,
+		Culprit:      source.Culprit,
+		Status:       models.IssueUnresolved,
+	}
+
+	// Move the reports over
+	fps := r.Expr(input.Fingerprints)
+	if err := r.DB(*rethinkdbDatabase).Table("reports").GetAllByIndex("issue_id", source.ID).Filter(func(row r.Term) r.Term {
+		return fps.Contains(row.Field("fingerprint"))
+	}).Update(map[string]interface{}{
+		"issue_id": issue.ID,
+	}).Exec(session); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Recompute the counters from the moved reports
+	cursor, err := r.DB(*rethinkdbDatabase).Table("reports").GetAllByIndex("issue_id", issue.ID).OrderBy("received_at").Run(session)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var reports []*models.Report
+	if err := cursor.All(&reports); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	// Dropped events aren't stored and are only known by their fingerprint
+	for _, fp := range input.Fingerprints {
+		if dropped, ok := source.DroppedFingerprints[fp]; ok {
+			if issue.DroppedFingerprints == nil {
+				issue.DroppedFingerprints = map[string]int{}
+			}
+			issue.DroppedFingerprints[fp] = dropped
+			issue.Dropped += dropped
+			delete(source.DroppedFingerprints, fp)
+		}
+	}
+	issue.Count = issue.Dropped
+	for _, report := range reports {
+		issue.Count += 1 + report.Repeats
+	}
+
+	issue.FirstSeen = time.Now()
+	issue.LastSeen = issue.FirstSeen
+	if len(reports) > 0 {
+		first, last := reports[0], reports[len(reports)-1]
+
+		issue.FirstSeen = first.ReceivedAt
+		issue.FirstCommit = first.CommitID
+		issue.LastSeen = last.ReceivedAt
+		issue.LastCommit = last.CommitID
+		issue.LastVersion = last.Version
+		if len(last.Entries) > 0 {
+			issue.Message = last.Entries[len(last.Entries)-1].Message
+		}
+	}
+
+	if err := r.DB(*rethinkdbDatabase).Table("issues").Insert(issue).Exec(session); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err := insertActivity(&models.Activity{
+		IssueID: issue.ID,
+		Type:    models.ActivityUnmerged,
+		Actor:   input.Actor,
+		Data: map[string]interface{}{
+			"from":         source.ID,
+			"fingerprints": input.Fingerprints,
+		},
+	}); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	source.Fingerprints = remaining
+	if containsString(input.Fingerprints, source.Fingerprint) {
+		source.Fingerprint = remaining[0]
+	}
+	source.Count -= issue.Count
+	if source.Count < 0 {
+		source.Count = 0
+	}
+	source.Dropped -= issue.Dropped
+	if source.Dropped < 0 {
+		source.Dropped = 0
+	}
+
+	updateIssueStatus(w, source, &models.Activity{
+		Type:  models.ActivityUnmerged,
+		Actor: input.Actor,
+		Data: map[string]interface{}{
+			"into":         issue.ID,
+			"fingerprints": input.Fingerprints,
+		},
+	})
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
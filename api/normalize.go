@@ -0,0 +1,77 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// Message normalizers, applied in order. Each of them replaces the variable
+// parts of an error message with a placeholder so that messages differing
+// only by IDs or values are grouped together. Normalizers without a pattern
+// use their own replacement function.
+var messageNormalizers = []struct {
+	Pattern     *regexp.Regexp
+	Placeholder string
+	Replace     func(string) string
+}{
+	{regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^\s'"<>]+`), "<url>", nil},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}\b`), "<uuid>", nil},
+	{regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`), "<hex>", nil},
+	{nil, "<str>", replaceQuoted},
+	{regexp.MustCompile(`\b[0-9a-fA-F]{8,}\b`), "<hex>", nil},
+	{regexp.MustCompile(`\b\d+(?:\.\d+)?\b`), "<num>", nil},
+}
+
+// normalizeMessage strips the variable parts of a message for grouping. The
+// original message is kept for display.
+func normalizeMessage(message string) string {
+	for _, normalizer := range messageNormalizers {
+		if normalizer.Pattern == nil {
+			message = normalizer.Replace(message)
+			continue
+		}
+
+		placeholder := normalizer.Placeholder
+		message = normalizer.Pattern.ReplaceAllStringFunc(message, func(match string) string {
+			// Long plain words like "deadbeef" or "facade" aren't IDs
+			if placeholder == "<hex>" && !strings.HasPrefix(match, "0x") && !strings.ContainsAny(match, "0123456789") {
+				return match
+			}
+
+			return placeholder
+		})
+	}
+
+	return message
+}
+
+// replaceQuoted replaces the quoted literals of a message. A quote opens a
+// literal at the start of a word and closes it at the end of one, so that
+// apostrophes as in "don't" or "users'" don't delimit literals.
+func replaceQuoted(message string) string {
+	runes := []rune(message)
+	isWord := func(i int) bool {
+		return i >= 0 && i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]))
+	}
+
+	result := []rune{}
+	for i := 0; i < len(runes); i++ {
+		quote := runes[i]
+		if (quote == '\'' || quote == '"' || quote == '`') && !isWord(i-1) && isWord(i+1) {
+			end := i + 1
+			for end < len(runes) && (runes[end] != quote || isWord(end+1)) {
+				end++
+			}
+			if end < len(runes) {
+				result = append(result, []rune("<str>")...)
+				i = end
+				continue
+			}
+		}
+
+		result = append(result, quote)
+	}
+
+	return string(result)
+}
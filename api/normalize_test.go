@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+func TestNormalizeMessage(t *testing.T) {
+	tests := []struct {
+		message, expected string
+	}{
+		{"Cannot read property 'foo' of undefined", "Cannot read property <str> of undefined"},
+		{`Unexpected token "}" in JSON`, `Unexpected token "}" in JSON`},
+		{`Unknown column "name" in table`, "Unknown column <str> in table"},
+		{"Template `header` not found", "Template <str> not found"},
+		{"users' data isn't 'loaded'", "users' data isn't <str>"},
+		{"Can't find 'it's here' anywhere", "Can't find <str> anywhere"},
+		{"The users' session expired", "The users' session expired"},
+		{"'unterminated literal", "'unterminated literal"},
+		{"Request 42 took 1.5 s", "Request <num> took <num> s"},
+		{"Item 42 of 100 failed", "Item <num> of <num> failed"},
+		{"Invalid pointer 0xdeadbeef", "Invalid pointer <hex>"},
+		{"Commit 3f2a9c1e4b not found", "Commit <hex> not found"},
+		{"Unknown facade deadbeef", "Unknown facade deadbeef"},
+		{"User 123e4567-e89b-12d3-a456-426614174000 is missing", "User <uuid> is missing"},
+		{"Failed to load https://example.com/app.js?v=2", "Failed to load <url>"},
+		{"Failed to load 'https://example.com/app.js'", "Failed to load '<url>'"},
+	}
+
+	for _, test := range tests {
+		if result := normalizeMessage(test.message); result != test.expected {
+			t.Errorf("normalizeMessage(%q) = %q, expected %q", test.message, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Markers of values cut by normalizeValue
+const (
+	truncatedMarker = "[Truncated]"
+	depthMarker     = "[Object]"
+	moreKey         = "[More]"
+)
+
+// Matches console format directives
+var formatPattern = regexp.MustCompile(`%[sdifoOc%]`)
+
+// normalizeObjects renders console format substitutions of the log's
+// messages and caps the size of the remaining objects.
+func normalizeObjects(lo *models.Log) {
+	eachEntry(lo, func(entry *models.LogEntry) {
+		objects, _ := entry.Objects.([]interface{})
+
+		if len(objects) > 0 && formatPattern.MatchString(entry.Message) {
+			message, rest := formatMessage(entry.Message, objects)
+			if message != entry.Message {
+				if entry.OriginalMessage == "" {
+					entry.OriginalMessage = entry.Message
+				}
+				entry.Message = message
+			}
+			objects = rest
+		}
+
+		if objects == nil {
+			return
+		}
+
+		normalized := []interface{}{}
+		for i, object := range objects {
+			if i >= *maxObjectBreadth {
+				normalized = append(normalized, strconv.Itoa(len(objects)-i)+" more objects "+truncatedMarker)
+				break
+			}
+
+			normalized = append(normalized, normalizeValue(object, 0))
+		}
+		entry.Objects = normalized
+	})
+}
+
+// formatMessage applies console.log-style substitutions, returning the
+// formatted message and the objects that weren't consumed.
+func formatMessage(format string, objects []interface{}) (string, []interface{}) {
+	used := 0
+	message := formatPattern.ReplaceAllStringFunc(format, func(directive string) string {
+		if directive == "%%" {
+			return "%"
+		}
+		if used >= len(objects) {
+			return directive
+		}
+
+		object := objects[used]
+		used++
+
+		switch directive[1] {
+		case 's':
+			return displayValue(object)
+		case 'd', 'i':
+			if x, ok := toNumber(object); ok {
+				return strconv.FormatFloat(math.Trunc(x), 'f', -1, 64)
+			}
+			return "NaN"
+		case 'f':
+			if x, ok := toNumber(object); ok {
+				return strconv.FormatFloat(x, 'f', -1, 64)
+			}
+			return "NaN"
+		case 'c':
+			// CSS styling has no meaning outside of the console
+			return ""
+		}
+
+		// %o and %O
+		return encodeJSON(normalizeValue(object, 0))
+	})
+
+	return message, objects[used:]
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch value := value.(type) {
+	case float64:
+		return value, true
+	case json.Number:
+		x, err := value.Float64()
+		return x, err == nil
+	case string:
+		x, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		return x, err == nil
+	case bool:
+		if value {
+			return 1, true
+		}
+		return 0, true
+	}
+
+	return 0, false
+}
+
+// displayValue renders a value the way %s would.
+func displayValue(value interface{}) string {
+	switch value := normalizeValue(value, 0).(type) {
+	case string:
+		return value
+	case nil:
+		return "null"
+	default:
+		return encodeJSON(value)
+	}
+}
+
+// normalizeValue caps the depth, breadth and string lengths of a value and
+// turns serialized DOM elements and errors into readable values.
+func normalizeValue(value interface{}, depth int) interface{} {
+	switch value := value.(type) {
+	case string:
+		if len(value) > *maxObjectString {
+			// Don't cut UTF-8 sequences in half
+			cut := *maxObjectString
+			for cut > 0 && value[cut]&0xC0 == 0x80 {
+				cut--
+			}
+			return value[:cut] + "..." + truncatedMarker
+		}
+		return value
+	case []interface{}:
+		if depth >= *maxObjectDepth {
+			return "[Array] " + truncatedMarker
+		}
+
+		result := []interface{}{}
+		for i, item := range value {
+			if i >= *maxObjectBreadth {
+				result = append(result, strconv.Itoa(len(value)-i)+" more items "+truncatedMarker)
+				break
+			}
+			result = append(result, normalizeValue(item, depth+1))
+		}
+		return result
+	case map[string]interface{}:
+		if element, ok := describeElement(value); ok {
+			return element
+		}
+		if err, ok := describeError(value); ok {
+			return err
+		}
+		if depth >= *maxObjectDepth {
+			return depthMarker + " " + truncatedMarker
+		}
+
+		// Keep the output stable when cutting keys
+		keys := []string{}
+		for key := range value {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		result := map[string]interface{}{}
+		for i, key := range keys {
+			if i >= *maxObjectBreadth {
+				result[moreKey] = strconv.Itoa(len(keys)-i) + " more keys " + truncatedMarker
+				break
+			}
+			result[key] = normalizeValue(value[key], depth+1)
+		}
+		return result
+	}
+
+	return value
+}
+
+// describeElement renders a serialized DOM element, ie. an object with a
+// tagName or nodeName, as a CSS-like selector.
+func describeElement(value map[string]interface{}) (string, bool) {
+	tag, ok := value["tagName"].(string)
+	if !ok {
+		tag, ok = value["nodeName"].(string)
+	}
+	if !ok || tag == "" {
+		return "", false
+	}
+
+	result := "<" + strings.ToLower(tag)
+	if id, ok := value["id"].(string); ok && id != "" {
+		result += "#" + id
+	}
+	if class, ok := value["className"].(string); ok && class != "" {
+		result += "." + strings.Join(strings.Fields(class), ".")
+	}
+
+	return result + ">", true
+}
+
+// describeError keeps the meaningful fields of a serialized Error, ie. an
+// object with a message and either a stack, frames or an *Error name.
+func describeError(value map[string]interface{}) (map[string]interface{}, bool) {
+	message, ok := value["message"].(string)
+	if !ok {
+		return nil, false
+	}
+	name, _ := value["name"].(string)
+	stack, hasStack := value["stack"].(string)
+	frames, hasFrames := value["frames"]
+	if !hasStack && !hasFrames && !strings.HasSuffix(name, "Error") {
+		return nil, false
+	}
+
+	if name == "" {
+		name = "Error"
+	}
+
+	result := map[string]interface{}{
+		"name":    name,
+		"message": normalizeValue(message, 0),
+	}
+	if hasStack {
+		result["stack"] = normalizeValue(stack, 0)
+	}
+	// Symbolicated by symbolicateObjects
+	if hasFrames {
+		result["frames"] = frames
+	}
+
+	return result, true
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/lavab/lavatrace/models"
+)
+
+// prepareLog symbolicates a report along with the stacks logged in its
+// objects, formats its messages and rewrites them into their canonical form.
+func prepareLog(report *models.Report) (*models.Log, error) {
+	lo, err := buildLog(report)
+	if err != nil {
+		return nil, err
+	}
+
+	symbolicateObjects(report, lo)
+	normalizeObjects(lo)
+	translateLog(lo)
+	decodeReactErrors(lo)
+
+	return lo, nil
+}
+
+// eachEntry calls fn for every entry of the log, including the nested causes
+// and inner errors.
+func eachEntry(lo *models.Log, fn func(*models.LogEntry)) {
+	var walk func(*models.LogEntry)
+	walk = func(entry *models.LogEntry) {
+		fn(entry)
+
+		if entry.Cause != nil {
+			walk(entry.Cause)
+		}
+		for _, inner := range entry.Errors {
+			walk(inner)
+		}
+	}
+
+	for _, entry := range lo.Entries {
+		walk(entry)
+	}
+}
+
+// eachReportEntry calls fn for every entry of the report, including the
+// nested causes and inner errors.
+func eachReportEntry(report *models.Report, fn func(*models.Entry)) {
+	var walk func(*models.Entry)
+	walk = func(entry *models.Entry) {
+		fn(entry)
+
+		if entry.Cause != nil {
+			walk(entry.Cause)
+		}
+		for _, inner := range entry.Errors {
+			walk(inner)
+		}
+	}
+
+	for _, entry := range report.Entries {
+		walk(entry)
+	}
+}
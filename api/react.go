@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+//go:generate go run gen_react_codes.go
+
+var reactErrorLock sync.RWMutex
+
+// Matches both the reactjs.org/docs/error-decoder.html and react.dev/errors
+// flavours of the message
+var reactErrorPattern = regexp.MustCompile(`Minified React error #(\d+); visit (\S+) for the full message`)
+
+// loadReactErrorCodes merges a codes.json file into the bundled table.
+func loadReactErrorCodes(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var codes map[string]string
+	if err := json.Unmarshal(data, &codes); err != nil {
+		return err
+	}
+
+	reactErrorLock.Lock()
+	defer reactErrorLock.Unlock()
+
+	for code, message := range codes {
+		reactErrorCodes[code] = message
+	}
+
+	return nil
+}
+
+// decodeReactError expands a minified React production error into the full
+// developer message. It returns false if the message isn't one or the code is
+// unknown.
+func decodeReactError(message string) (string, bool) {
+	match := reactErrorPattern.FindStringSubmatch(message)
+	if match == nil {
+		return message, false
+	}
+
+	// Keep the error type prefix, if there's any
+	prefix := message[:strings.Index(message, match[0])]
+
+	reactErrorLock.RLock()
+	format, ok := reactErrorCodes[match[1]]
+	reactErrorLock.RUnlock()
+	if !ok {
+		return message, false
+	}
+
+	// Arguments are passed as args[]=... in the decoder URL
+	var args []string
+	if u, err := url.Parse(match[2]); err == nil {
+		args = u.Query()["args[]"]
+	}
+
+	parts := strings.Split(format, "%s")
+	result := prefix + parts[0]
+	for i, part := range parts[1:] {
+		if i < len(args) {
+			result += args[i]
+		}
+		result += part
+	}
+
+	return result, true
+}
+
+// decodeReactErrors expands the log's minified React errors, keeping the
+// original messages.
+func decodeReactErrors(lo *models.Log) {
+	eachEntry(lo, func(entry *models.LogEntry) {
+		decoded, ok := decodeReactError(entry.Message)
+		if !ok {
+			return
+		}
+
+		if entry.OriginalMessage == "" {
+			entry.OriginalMessage = entry.Message
+		}
+		entry.Message = decoded
+	})
+}
@@ -0,0 +1,27 @@
+package main
+
+// reactErrorCodes is a hand-picked subset of React's codes.json, with the
+// errors most commonly seen in production. The full file can be merged at
+// runtime with -react_error_codes, or bundled by running go generate, which
+// replaces this file with gen_react_codes.go's output.
+var reactErrorCodes = map[string]string{
+	"31":  "Objects are not valid as a React child (found: %s). If you meant to render a collection of children, use an array instead.",
+	"62":  "The `style` prop expects a mapping from style properties to values, not a string. For example, style={{marginRight: spacing + 'em'}} when using JSX.%s",
+	"130": "Element type is invalid: expected a string (for built-in components) or a class/function (for composite components) but got: %s.%s",
+	"137": "%s is a void element tag and must neither have `children` nor use `dangerouslySetInnerHTML`.%s",
+	"152": "%s(...): Nothing was returned from render. This usually means a return statement is missing. Or, to render nothing, return null.",
+	"185": "Maximum update depth exceeded. This can happen when a component repeatedly calls setState inside componentWillUpdate or componentDidUpdate. React limits the number of nested updates to prevent infinite loops.",
+	"188": "Unable to find node on an unmounted component.",
+	"200": "Target container is not a DOM element.",
+	"300": "Rendered fewer hooks than expected. This may be caused by an accidental early return statement.",
+	"301": "Too many re-renders. React limits the number of renders to prevent an infinite loop.",
+	"310": "Rendered more hooks than during the previous render.",
+	"321": "Invalid hook call. Hooks can only be called inside of the body of a function component. This could happen for one of the following reasons:\n1. You might have mismatching versions of React and the renderer (such as React DOM)\n2. You might be breaking the Rules of Hooks\n3. You might have more than one copy of React in the same app\nSee https://reactjs.org/link/invalid-hook-call for tips about how to debug and fix this problem.",
+	"327": "Should not already be working.",
+	"418": "Hydration failed because the initial UI does not match what was rendered on the server.",
+	"419": "The server could not finish this Suspense boundary, likely due to an error during server rendering. Switched to client rendering.",
+	"422": "There was an error while hydrating this Suspense boundary. Switched to client rendering.",
+	"423": "There was an error while hydrating. Because the error happened outside of a Suspense boundary, the entire root will switch to client rendering.",
+	"425": "Text content does not match server-rendered HTML.",
+	"426": "A component suspended while responding to synchronous input. This will cause the UI to be replaced with a loading indicator. To fix, updates that suspend should be wrapped with startTransition.",
+}
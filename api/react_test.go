@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestDecodeReactError(t *testing.T) {
+	tests := []struct {
+		message, expected string
+		ok                bool
+	}{
+		{
+			"Minified React error #200; visit https://reactjs.org/docs/error-decoder.html?invariant=200 for the full message or use the non-minified dev environment for full errors and additional helpful warnings.",
+			"Target container is not a DOM element.",
+			true,
+		},
+		{
+			"Error: Minified React error #31; visit https://reactjs.org/docs/error-decoder.html?invariant=31&args[]=object%20with%20keys%20%7Bid%7D for the full message",
+			"Error: Objects are not valid as a React child (found: object with keys {id}). If you meant to render a collection of children, use an array instead.",
+			true,
+		},
+		{
+			"Minified React error #130; visit https://react.dev/errors/130?args[]=undefined for the full message",
+			"Element type is invalid: expected a string (for built-in components) or a class/function (for composite components) but got: undefined.",
+			true,
+		},
+		{
+			"Minified React error #99999; visit https://react.dev/errors/99999 for the full message",
+			"Minified React error #99999; visit https://react.dev/errors/99999 for the full message",
+			false,
+		},
+		{
+			"TypeError: x is undefined",
+			"TypeError: x is undefined",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		message, ok := decodeReactError(test.message)
+		if message != test.expected || ok != test.ok {
+			t.Errorf("decodeReactError(%q) = %q, %v, expected %q, %v", test.message, message, ok, test.expected, test.ok)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math/rand"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Reasons for not keeping a report
+const (
+	dropSampled     = "sampled"
+	dropRateLimited = "rate_limited"
+)
+
+// SamplingRule sets the rate of the reports matching a version or message
+// pattern, eg. `version:1.2.* 0.1` or `message:/timeout/ 0`.
+type SamplingRule struct {
+	Raw     string         `json:"rule"`
+	Version *regexp.Regexp `json:"-"`
+	Message *regexp.Regexp `json:"-"`
+	Rate    float64        `json:"rate"`
+}
+
+// Rules in order of precedence, the first match sets the rate
+var samplingRules = []*SamplingRule{}
+
+// parseSamplingRules parses one rule per line, ignoring blank lines and
+// comments starting with #.
+func parseSamplingRules(input string) ([]*SamplingRule, error) {
+	rules := []*SamplingRule{}
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		rule, err := parseSamplingRule(line)
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+
+		rules = append(rules, rule)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return rules, nil
+}
+
+func parseSamplingRule(line string) (*SamplingRule, error) {
+	tokens := ruleToken.FindAllStringSubmatch(line, -1)
+	if len(tokens) != 2 || tokens[0][1] == "" {
+		return nil, errors.New("expected a matcher and a rate")
+	}
+
+	rule := &SamplingRule{
+		Raw: line,
+	}
+
+	rate, err := strconv.ParseFloat(tokens[1][0], 64)
+	if err != nil || rate < 0 || rate > 1 {
+		return nil, errors.New("rate must be between 0 and 1")
+	}
+	rule.Rate = rate
+
+	pattern, err := matcherPattern(tokens[0][1], tokens[0][2])
+	if err != nil {
+		return nil, err
+	}
+	switch tokens[0][1] {
+	case "version":
+		rule.Version = pattern
+	case "message":
+		rule.Message = pattern
+	default:
+		return nil, errors.New("unknown matcher " + tokens[0][1])
+	}
+
+	return rule, nil
+}
+
+// reportSampleRate returns the rate of the first rule matching the report,
+// or the global rate.
+func reportSampleRate(report *models.Report, message string) float64 {
+	for _, rule := range samplingRules {
+		if rule.Version != nil && rule.Version.MatchString(report.Version) {
+			return rule.Rate
+		}
+		if rule.Message != nil && rule.Message.MatchString(message) {
+			return rule.Rate
+		}
+	}
+
+	return *sampleRate
+}
+
+// Events per fingerprint in the current minute
+type rateWindow struct {
+	Minute int64
+	Count  int
+}
+
+var (
+	rateWindows = map[string]*rateWindow{}
+	rateLock    sync.Mutex
+)
+
+// rateLimited counts an event of a fingerprint, returning whether the
+// fingerprint went over its per-minute cap.
+func rateLimited(fingerprint string) bool {
+	if *maxEventsPerMinute <= 0 {
+		return false
+	}
+
+	minute := time.Now().Unix() / 60
+
+	rateLock.Lock()
+	defer rateLock.Unlock()
+
+	window, ok := rateWindows[fingerprint]
+	if !ok || window.Minute != minute {
+		// Forget the fingerprints that weren't seen this minute
+		if !ok && len(rateWindows) >= 10000 {
+			for key, old := range rateWindows {
+				if old.Minute != minute {
+					delete(rateWindows, key)
+				}
+			}
+		}
+
+		window = &rateWindow{
+			Minute: minute,
+		}
+		rateWindows[fingerprint] = window
+	}
+
+	window.Count++
+	return window.Count > *maxEventsPerMinute
+}
+
+// Numbers of reports kept and dropped since the start
+var (
+	keptReports        int64
+	sampledReports     int64
+	rateLimitedReports int64
+)
+
+// sampleReport decides whether a grouped report should be stored and sent
+// to the sinks, returning the reason if it shouldn't.
+func sampleReport(report *models.Report, message string) string {
+	if rate := reportSampleRate(report, message); rate < 1 && rand.Float64() >= rate {
+		atomic.AddInt64(&sampledReports, 1)
+		return dropSampled
+	}
+
+	// Only the events that would be kept use the cap
+	if rateLimited(report.Fingerprint) {
+		atomic.AddInt64(&rateLimitedReports, 1)
+		return dropRateLimited
+	}
+
+	atomic.AddInt64(&keptReports, 1)
+	return ""
+}
+
+// GET /sampling - the sampling configuration and counters since the start
+func showSampling(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"rate":                  *sampleRate,
+		"rules":                 samplingRules,
+		"max_events_per_minute": *maxEventsPerMinute,
+		"kept":                  atomic.LoadInt64(&keptReports),
+		"sampled":               atomic.LoadInt64(&sampledReports),
+		"rate_limited":          atomic.LoadInt64(&rateLimitedReports),
+	})
+}
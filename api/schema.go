@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// SchemaError is a single JSON Schema validation failure. Path is a JSON
+// pointer to the invalid value.
+type SchemaError struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+// Compiled "pattern" keywords, shared by all the schemas
+var (
+	schemaPatterns    = map[string]*regexp.Regexp{}
+	schemaPatternLock sync.Mutex
+)
+
+// validateSchema validates a value decoded with json.Decoder.UseNumber
+// against a JSON Schema. It supports the subset of draft-04 used by the
+// report schemas: type, enum, properties, required, additionalProperties,
+// items, minItems, maxItems, minLength, maxLength, pattern, minimum, maximum
+// and local $refs.
+func validateSchema(schema map[string]interface{}, value interface{}) []*SchemaError {
+	v := &schemaValidator{
+		root:   schema,
+		errors: []*SchemaError{},
+	}
+	v.validate(schema, value, "")
+	return v.errors
+}
+
+type schemaValidator struct {
+	root   map[string]interface{}
+	errors []*SchemaError
+}
+
+func (v *schemaValidator) fail(path, format string, args ...interface{}) {
+	if path == "" {
+		path = "/"
+	}
+
+	v.errors = append(v.errors, &SchemaError{
+		Path:    path,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *schemaValidator) validate(schema map[string]interface{}, value interface{}, path string) {
+	// Resolve "#/definitions/name" references
+	if ref, ok := schema["$ref"].(string); ok {
+		target := v.root
+		for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			target, _ = target[part].(map[string]interface{})
+		}
+		if target == nil {
+			v.fail(path, "unresolvable schema reference %s", ref)
+			return
+		}
+
+		v.validate(target, value, path)
+		return
+	}
+
+	if types, ok := schema["type"]; ok && !matchesType(types, value) {
+		v.fail(path, "expected %s, got %s", typeNames(types), jsonType(value))
+		return
+	}
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, option := range enum {
+			if jsonEqual(option, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			v.fail(path, "must be one of %s", encodeJSON(enum))
+		}
+	}
+
+	switch value := value.(type) {
+	case string:
+		length := utf8.RuneCountInString(value)
+		if min, ok := schemaInt(schema, "minLength"); ok && length < min {
+			v.fail(path, "must be at least %d characters long", min)
+		}
+		if max, ok := schemaInt(schema, "maxLength"); ok && length > max {
+			v.fail(path, "must be at most %d characters long", max)
+		}
+		if pattern, ok := schema["pattern"].(string); ok && !compileSchemaPattern(pattern).MatchString(value) {
+			v.fail(path, "must match the pattern %s", pattern)
+		}
+	case json.Number:
+		x, _ := value.Float64()
+		if min, ok := schemaInt(schema, "minimum"); ok && x < float64(min) {
+			v.fail(path, "must be at least %d", min)
+		}
+		if max, ok := schemaInt(schema, "maximum"); ok && x > float64(max) {
+			v.fail(path, "must be at most %d", max)
+		}
+	case []interface{}:
+		if min, ok := schemaInt(schema, "minItems"); ok && len(value) < min {
+			v.fail(path, "must contain at least %d items", min)
+		}
+		if max, ok := schemaInt(schema, "maxItems"); ok && len(value) > max {
+			v.fail(path, "must contain at most %d items", max)
+			return
+		}
+		if items, ok := schema["items"].(map[string]interface{}); ok {
+			for i, item := range value {
+				v.validate(items, item, path+"/"+strconv.Itoa(i))
+			}
+		}
+	case map[string]interface{}:
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := value[name.(string)]; !ok {
+					v.fail(path+"/"+name.(string), "is required")
+				}
+			}
+		}
+
+		// Sorted so that the errors are reported in a stable order
+		names := []string{}
+		for name := range value {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		properties, _ := schema["properties"].(map[string]interface{})
+		for _, name := range names {
+			property := value[name]
+			if ps, ok := properties[name].(map[string]interface{}); ok {
+				v.validate(ps, property, path+"/"+escapePointer(name))
+				continue
+			}
+
+			switch additional := schema["additionalProperties"].(type) {
+			case bool:
+				if !additional {
+					v.fail(path+"/"+escapePointer(name), "is not allowed")
+				}
+			case map[string]interface{}:
+				v.validate(additional, property, path+"/"+escapePointer(name))
+			}
+		}
+	}
+}
+
+func compileSchemaPattern(pattern string) *regexp.Regexp {
+	schemaPatternLock.Lock()
+	defer schemaPatternLock.Unlock()
+
+	re, ok := schemaPatterns[pattern]
+	if !ok {
+		re = regexp.MustCompile(pattern)
+		schemaPatterns[pattern] = re
+	}
+
+	return re
+}
+
+func schemaInt(schema map[string]interface{}, key string) (int, bool) {
+	x, ok := schema[key].(int)
+	return x, ok
+}
+
+func matchesType(types interface{}, value interface{}) bool {
+	switch types := types.(type) {
+	case string:
+		actual := jsonType(value)
+		return actual == types || (types == "number" && actual == "integer")
+	case []interface{}:
+		for _, t := range types {
+			if matchesType(t, value) {
+				return true
+			}
+		}
+	case []string:
+		for _, t := range types {
+			if matchesType(t, value) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func typeNames(types interface{}) string {
+	switch types := types.(type) {
+	case []string:
+		return strings.Join(types, " or ")
+	case []interface{}:
+		names := []string{}
+		for _, t := range types {
+			names = append(names, fmt.Sprint(t))
+		}
+		return strings.Join(names, " or ")
+	}
+
+	return fmt.Sprint(types)
+}
+
+func jsonType(value interface{}) string {
+	switch value := value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case string:
+		return "string"
+	case json.Number:
+		if _, err := value.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+
+	return "unknown"
+}
+
+func jsonEqual(a, b interface{}) bool {
+	return encodeJSON(a) == encodeJSON(b)
+}
+
+func encodeJSON(value interface{}) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
+
+// escapePointer escapes a JSON pointer token.
+func escapePointer(token string) string {
+	return strings.Replace(strings.Replace(token, "~", "~0", -1), "/", "~1", -1)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+var testSchema = map[string]interface{}{
+	"type":                 "object",
+	"additionalProperties": false,
+	"required":             []interface{}{"name"},
+	"properties": map[string]interface{}{
+		"name": map[string]interface{}{
+			"type":      "string",
+			"minLength": 1,
+			"maxLength": 5,
+			"pattern":   "^[a-z]+$",
+		},
+		"kind": map[string]interface{}{
+			"enum": []interface{}{"a", "b"},
+		},
+		"size": map[string]interface{}{
+			"type":    []interface{}{"integer", "null"},
+			"minimum": 0,
+			"maximum": 10,
+		},
+		"ratio": map[string]interface{}{
+			"type": "number",
+		},
+		"items": map[string]interface{}{
+			"type":     "array",
+			"maxItems": 2,
+			"items": map[string]interface{}{
+				"$ref": "#/definitions/item",
+			},
+		},
+		"tags": map[string]interface{}{
+			"type": "object",
+			"additionalProperties": map[string]interface{}{
+				"type": "string",
+			},
+		},
+	},
+	"definitions": map[string]interface{}{
+		"item": map[string]interface{}{
+			"type":     "object",
+			"required": []interface{}{"id"},
+		},
+	},
+}
+
+func TestValidateSchema(t *testing.T) {
+	tests := []struct {
+		value  string
+		errors []string
+	}{
+		{`{"name": "abc"}`, nil},
+		{`{"name": "abc", "kind": "b", "size": null, "ratio": 1, "items": [{"id": 1}], "tags": {"a": "b"}}`, nil},
+		{`{"name": "abc", "size": 10, "ratio": 0.5}`, nil},
+		{`[]`, []string{"/: expected object, got array"}},
+		{`{}`, []string{"/name: is required"}},
+		{`{"name": 1}`, []string{"/name: expected string, got integer"}},
+		{`{"name": ""}`, []string{"/name: must be at least 1 characters long", "/name: must match the pattern ^[a-z]+$"}},
+		{`{"name": "abcdef"}`, []string{"/name: must be at most 5 characters long"}},
+		{`{"name": "ABC"}`, []string{"/name: must match the pattern ^[a-z]+$"}},
+		{`{"name": "abc", "kind": "c"}`, []string{`/kind: must be one of ["a","b"]`}},
+		{`{"name": "abc", "size": 1.5}`, []string{"/size: expected integer or null, got number"}},
+		{`{"name": "abc", "size": -1}`, []string{"/size: must be at least 0"}},
+		{`{"name": "abc", "size": 11}`, []string{"/size: must be at most 10"}},
+		{`{"name": "abc", "items": [{}, {"id": 1}]}`, []string{"/items/0/id: is required"}},
+		{`{"name": "abc", "items": [{}, {}, {}]}`, []string{"/items: must contain at most 2 items"}},
+		{`{"name": "abc", "tags": {"a/b": 1}}`, []string{"/tags/a~1b: expected string, got integer"}},
+		{`{"name": "abc", "other": true, "more~": 1}`, []string{"/more~0: is not allowed", "/other: is not allowed"}},
+	}
+
+	for _, test := range tests {
+		var value interface{}
+		decoder := json.NewDecoder(strings.NewReader(test.value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			t.Fatal(err)
+		}
+
+		errors := []string{}
+		for _, err := range validateSchema(testSchema, value) {
+			errors = append(errors, err.Path+": "+err.Message)
+		}
+		if strings.Join(errors, "\n") != strings.Join(test.errors, "\n") {
+			t.Errorf("Validating %s returned %q, expected %q", test.value, errors, test.errors)
+		}
+	}
+}
+
+func TestParseReport(t *testing.T) {
+	reportSchemas = buildReportSchemas()
+
+	nested := `{"message": "root"}`
+	for i := 0; i <= maxCauseDepth; i++ {
+		nested = `{"message": "error", "cause": ` + nested + `}`
+	}
+
+	tests := []struct {
+		body  string
+		error string
+	}{
+		{`{"commitID": "abc", "entries": [{"message": "x", "stacktrace": "0:1:2;native:0:0"}], "assets": ["app.js"]}`, ""},
+		{`{"schema": 2, "commitID": "abc", "entries": [{"message": "x", "frames": [{"asset": 0, "line": 1, "column": 2}]}], "assets": ["app.js"]}`, ""},
+		{`{"commitID": "abc", "entries": []}`, "/entries: must contain at least 1 items"},
+		{`{"commitID": "abc", "entries": [null]}`, "/entries/0: expected object, got null"},
+		{`{"commitID": "abc", "entries": [{"message": "x", "stacktrace": "1:1:2"}], "assets": ["app.js"]}`, "/entries/0/stacktrace: frame 0 refers to a missing asset"},
+		{`{"schema": 2, "commitID": "abc", "entries": [{"message": "x", "frames": [{"asset": 1, "line": 1, "column": 2}]}]}`, "/entries/0/frames/0/asset: refers to a missing asset"},
+		{`{"schema": 3, "commitID": "abc", "entries": [{"message": "x"}]}`, "/schema: unsupported schema version"},
+		{`{"commitID": "abc", "entries": [` + nested + `]}`, "must be nested at most"},
+	}
+
+	for _, test := range tests {
+		_, err := parseReport([]byte(test.body))
+		switch {
+		case test.error == "" && err != nil:
+			t.Errorf("Parsing %s failed: %v", test.body, err)
+		case test.error != "" && (err == nil || !strings.Contains(err.Error(), test.error)):
+			t.Errorf("Parsing %s returned %v, expected %q", test.body, err, test.error)
+		}
+	}
+
+	if _, err := parseReport([]byte("{")); err == nil {
+		t.Error("Parsed invalid JSON")
+	}
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Replaces the scrubbed values
+const filteredMarker = "[Filtered]"
+
+// scrubDetector redacts one kind of sensitive data. Groups of the pattern
+// named "keep" are kept around the marker, eg. the name of a query param.
+type scrubDetector struct {
+	Name    string
+	Pattern *regexp.Regexp
+
+	// Optional check of the matches, eg. the Luhn checksum of card numbers
+	Validate func(string) bool
+
+	// Index of the "keep" group, set up by setupScrubbers
+	keep int
+}
+
+// Built-in detectors, in the order they're applied
+var builtinDetectors = []*scrubDetector{
+	{
+		Name:    "url_secret",
+		Pattern: regexp.MustCompile(`(?i)(?P<keep>[?&;](?:[\w.-]*(?:token|key|secret|password|passwd|auth|session|sig)[\w.-]*)=)[^&#\s"'<>]+`),
+	},
+	{
+		Name:    "bearer",
+		Pattern: regexp.MustCompile(`(?i)(?P<keep>\b(?:bearer|basic|token)\s+)[\w.~+/=-]{8,}`),
+	},
+	{
+		Name:    "jwt",
+		Pattern: regexp.MustCompile(`\beyJ[\w-]+\.eyJ[\w-]+\.[\w-]*`),
+	},
+	{
+		Name:    "email",
+		Pattern: regexp.MustCompile(`[\w.+-]+@[\w-]+(?:\.[\w-]+)*\.[a-zA-Z]{2,}\b`),
+	},
+	{
+		Name:     "credit_card",
+		Pattern:  regexp.MustCompile(`\b\d(?:[ -]?\d){12,18}\b`),
+		Validate: cardValid,
+	},
+}
+
+// Card issuer identification number ranges and the lengths of their cards,
+// so that other long numbers such as timestamps aren't taken for cards
+var cardIssuers = []struct {
+	From, To             string
+	MinLength, MaxLength int
+}{
+	{"4", "4", 13, 19},       // Visa
+	{"51", "55", 16, 16},     // Mastercard
+	{"2221", "2720", 16, 16}, // Mastercard
+	{"34", "34", 15, 15},     // American Express
+	{"37", "37", 15, 15},     // American Express
+	{"6011", "6011", 16, 19}, // Discover
+	{"644", "649", 16, 19},   // Discover
+	{"65", "65", 16, 19},     // Discover
+	{"300", "305", 14, 19},   // Diners Club
+	{"36", "36", 14, 19},     // Diners Club
+	{"38", "39", 14, 19},     // Diners Club
+	{"3528", "3589", 16, 19}, // JCB
+	{"62", "62", 16, 19},     // UnionPay
+	{"5018", "5018", 13, 19}, // Maestro
+	{"5020", "5020", 13, 19}, // Maestro
+	{"5038", "5038", 13, 19}, // Maestro
+	{"6304", "6304", 13, 19}, // Maestro
+	{"6759", "6759", 13, 19}, // Maestro
+	{"6761", "6763", 13, 19}, // Maestro
+}
+
+var (
+	// Detectors applied to every string
+	scrubDetectors []*scrubDetector
+
+	// Object keys whose values are always scrubbed, matched as substrings of
+	// the lowercased key
+	scrubKeys []string
+)
+
+// setupScrubbers enables the named built-in detectors, followed by the
+// custom ones, and sets the key denylist.
+func setupScrubbers(detectors, keys string, custom []*scrubDetector) error {
+	scrubDetectors = []*scrubDetector{}
+
+	enabled := map[string]bool{}
+	for _, name := range strings.Split(detectors, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		found := false
+		for _, detector := range builtinDetectors {
+			if detector.Name == name {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return errors.New("Unknown PII detector " + name)
+		}
+
+		enabled[name] = true
+	}
+	for _, detector := range builtinDetectors {
+		if enabled[detector.Name] {
+			scrubDetectors = append(scrubDetectors, detector)
+		}
+	}
+	scrubDetectors = append(scrubDetectors, custom...)
+
+	for _, detector := range scrubDetectors {
+		detector.keep = 0
+		for i, name := range detector.Pattern.SubexpNames() {
+			if name == "keep" {
+				detector.keep = i
+			}
+		}
+	}
+
+	scrubKeys = []string{}
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.ToLower(strings.TrimSpace(key))
+		if key != "" {
+			scrubKeys = append(scrubKeys, key)
+		}
+	}
+
+	return nil
+}
+
+// parseScrubRules parses custom detectors, one "name regexp" per line,
+// ignoring blank lines and comments starting with #.
+func parseScrubRules(input string) ([]*scrubDetector, error) {
+	detectors := []*scrubDetector{}
+
+	scanner := bufio.NewScanner(strings.NewReader(input))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[1]) == "" {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": expected a name and a pattern")
+		}
+
+		pattern, err := regexp.Compile(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, errors.New("line " + strconv.Itoa(n) + ": " + err.Error())
+		}
+
+		detectors = append(detectors, &scrubDetector{
+			Name:    parts[0],
+			Pattern: pattern,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return detectors, nil
+}
+
+// scrubReport redacts sensitive data from everything the client sent that
+// is stored or forwarded, except for the user, and returns the number of
+// redacted values by detector.
+func scrubReport(report *models.Report) map[string]int {
+	counts := map[string]int{}
+
+	eachReportEntry(report, func(entry *models.Entry) {
+		entry.Message = scrubString(entry.Message, counts)
+		for i, object := range entry.Objects {
+			entry.Objects[i] = scrubValue(object, counts)
+		}
+	})
+
+	for i, asset := range report.Assets {
+		report.Assets[i] = scrubString(asset, counts)
+	}
+	report.URL = scrubString(report.URL, counts)
+
+	for key, value := range report.Tags {
+		if scrubbedKey(key) {
+			report.Tags[key] = filteredMarker
+			counts["key"]++
+			continue
+		}
+		report.Tags[key] = scrubString(value, counts)
+	}
+	if report.Extra != nil {
+		report.Extra = scrubValue(report.Extra, counts).(map[string]interface{})
+	}
+
+	return counts
+}
+
+// scrubValue redacts the strings of a decoded JSON value and the values of
+// its denylisted keys.
+func scrubValue(value interface{}, counts map[string]int) interface{} {
+	switch value := value.(type) {
+	case string:
+		return scrubString(value, counts)
+	case []interface{}:
+		for i, item := range value {
+			value[i] = scrubValue(item, counts)
+		}
+	case map[string]interface{}:
+		for key, item := range value {
+			if item != nil && scrubbedKey(key) {
+				value[key] = filteredMarker
+				counts["key"]++
+				continue
+			}
+			value[key] = scrubValue(item, counts)
+		}
+	}
+
+	return value
+}
+
+// scrubString applies the detectors to a string.
+func scrubString(value string, counts map[string]int) string {
+	for _, detector := range scrubDetectors {
+		keep := detector.keep
+		value = detector.Pattern.ReplaceAllStringFunc(value, func(match string) string {
+			if detector.Validate != nil && !detector.Validate(match) {
+				return match
+			}
+			counts[detector.Name]++
+
+			if keep > 0 {
+				groups := detector.Pattern.FindStringSubmatch(match)
+				if groups != nil {
+					return groups[keep] + filteredMarker
+				}
+			}
+			return filteredMarker
+		})
+	}
+
+	return value
+}
+
+func scrubbedKey(key string) bool {
+	key = strings.ToLower(key)
+	for _, denied := range scrubKeys {
+		if strings.Contains(key, denied) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// cardValid checks the issuer, length and checksum of a card number.
+func cardValid(number string) bool {
+	digits := strings.Map(func(c rune) rune {
+		if c < '0' || c > '9' {
+			return -1
+		}
+		return c
+	}, number)
+
+	for _, issuer := range cardIssuers {
+		if len(digits) < issuer.MinLength || len(digits) > issuer.MaxLength {
+			continue
+		}
+
+		prefix := digits[:len(issuer.From)]
+		if prefix >= issuer.From && prefix <= issuer.To {
+			return luhnValid(digits)
+		}
+	}
+
+	return false
+}
+
+// luhnValid checks the checksum of a card number, ignoring separators.
+func luhnValid(number string) bool {
+	sum, double := 0, false
+	for i := len(number) - 1; i >= 0; i-- {
+		c := number[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+
+		digit := int(c - '0')
+		if double {
+			digit *= 2
+			if digit > 9 {
+				digit -= 9
+			}
+		}
+		sum += digit
+		double = !double
+	}
+
+	return sum%10 == 0
+}
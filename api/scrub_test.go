@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestCardValid(t *testing.T) {
+	tests := []struct {
+		number string
+		valid  bool
+	}{
+		{"4111111111111111", true},
+		{"4111 1111 1111 1111", true},
+		{"4111-1111-1111-1111", true},
+		{"5555555555554444", true},
+		{"2223003122003222", true},
+		{"378282246310005", true},
+		{"6011111111111117", true},
+		{"30569309025904", true},
+		{"3530111333300000", true},
+		{"6200000000000005", true},
+
+		// Wrong checksum
+		{"4111111111111112", false},
+		// Wrong length for the issuer
+		{"378282246310005 0", false},
+		{"555555555555444", false},
+		// No issuer, eg. timestamps and IDs
+		{"1697040000004", false},
+		{"9999999999999995", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		if valid := cardValid(test.number); valid != test.valid {
+			t.Errorf("cardValid(%q) = %v, expected %v", test.number, valid, test.valid)
+		}
+	}
+}
+
+func TestScrubString(t *testing.T) {
+	if err := setupScrubbers("credit_card,email", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	defer setupScrubbers("", "", nil)
+
+	tests := []struct {
+		value, expected string
+	}{
+		{"ts 1697040000004", "ts 1697040000004"},
+		{"card 4111 1111 1111 1111 declined", "card " + filteredMarker + " declined"},
+		{"mail john@example.com", "mail " + filteredMarker},
+	}
+
+	for _, test := range tests {
+		if result := scrubString(test.value, map[string]int{}); result != test.expected {
+			t.Errorf("scrubString(%q) = %q, expected %q", test.value, result, test.expected)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"regexp"
+	"strconv"
+
+	"github.com/lavab/raven-go"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Matches messages prefixed with the error type, eg. "TypeError: x is undefined"
+var errorTypePattern = regexp.MustCompile(`\A([\w$.]+): ([\s\S]*)\z`)
+
+// newPacket converts a symbolicated log into a Sentry packet, with the last
+// entry as the exception and all the others as breadcrumbs.
+func newPacket(report *models.Report, lo *models.Log) *raven.Packet {
+	kinds := []string{}
+	for _, entry := range lo.Entries {
+		kinds = append(kinds, entry.Type)
+	}
+
+	packet := &raven.Packet{
+		Interfaces: []raven.Interface{},
+		Platform:   "javascript",
+		Release:    report.CommitID,
+		Level:      mostSevere(kinds),
+	}
+
+	// Set the culprit and message
+	lastEntry := lo.Entries[len(lo.Entries)-1]
+	if len(lastEntry.Frames) > 0 {
+		lastFrame := lastEntry.Frames[len(lastEntry.Frames)-1]
+		packet.Culprit = lastFrame.Name + "@" + strconv.Itoa(lastFrame.LineNo) + ":" + strconv.Itoa(lastFrame.ColNo)
+	}
+	packet.Message = lastEntry.Message
+	if lastEntry.OriginalMessage != "" {
+		packet.Extra = map[string]interface{}{
+			"original_message": lastEntry.OriginalMessage,
+		}
+	}
+
+	if len(lo.Entries) > 1 {
+		packet.Interfaces = append(packet.Interfaces, newBreadcrumbs(lo.Entries[:len(lo.Entries)-1]))
+	}
+	packet.Interfaces = append(packet.Interfaces, newExceptions(lastEntry))
+
+	return packet
+}
+
+// exceptionList is the Sentry exception interface with chained exceptions.
+type exceptionList struct {
+	Values []*chainedException `json:"values"`
+}
+
+func (e *exceptionList) Class() string { return "exception" }
+
+type chainedException struct {
+	*raven.Exception
+	Mechanism *exceptionMechanism `json:"mechanism,omitempty"`
+}
+
+// exceptionMechanism describes how an exception relates to its parent.
+type exceptionMechanism struct {
+	Type             string `json:"type"`
+	Source           string `json:"source,omitempty"`
+	ExceptionID      int    `json:"exception_id"`
+	ParentID         *int   `json:"parent_id,omitempty"`
+	IsExceptionGroup bool   `json:"is_exception_group,omitempty"`
+}
+
+// newExceptions flattens an entry and its causes and inner errors into
+// chained exceptions. Sentry expects the main exception to be the last one.
+func newExceptions(entry *models.LogEntry) *exceptionList {
+	list := &exceptionList{
+		Values: []*chainedException{},
+	}
+
+	var walk func(entry *models.LogEntry, source string, parent *int)
+	walk = func(entry *models.LogEntry, source string, parent *int) {
+		id := len(list.Values)
+		exception := &chainedException{
+			Exception: newException(entry),
+			Mechanism: &exceptionMechanism{
+				Type:             "generic",
+				Source:           source,
+				ExceptionID:      id,
+				ParentID:         parent,
+				IsExceptionGroup: len(entry.Errors) > 0,
+			},
+		}
+		if parent != nil {
+			exception.Mechanism.Type = "chained"
+		}
+		list.Values = append(list.Values, exception)
+
+		if entry.Cause != nil {
+			walk(entry.Cause, "cause", &id)
+		}
+		for i, inner := range entry.Errors {
+			walk(inner, "errors["+strconv.Itoa(i)+"]", &id)
+		}
+	}
+	walk(entry, "", nil)
+
+	// Reverse so that the main exception is last
+	for i, j := 0, len(list.Values)-1; i < j; i, j = i+1, j-1 {
+		list.Values[i], list.Values[j] = list.Values[j], list.Values[i]
+	}
+
+	return list
+}
+
+// newException converts an entry into a Sentry exception.
+func newException(entry *models.LogEntry) *raven.Exception {
+	exception := &raven.Exception{
+		Type:  "Error",
+		Value: entry.Message,
+	}
+	if match := errorTypePattern.FindStringSubmatch(entry.Message); match != nil {
+		exception.Type, exception.Value = match[1], match[2]
+	}
+
+	// Sentry discards empty stacktraces
+	if len(entry.Frames) == 0 {
+		return exception
+	}
+
+	exception.Stacktrace = &raven.Stacktrace{
+		Frames: []*raven.StacktraceFrame{},
+	}
+	for _, frame := range entry.Frames {
+		exception.Stacktrace.Frames = append(exception.Stacktrace.Frames, &raven.StacktraceFrame{
+			Filename:     frame.Filename,
+			Function:     frame.Name,
+			Lineno:       frame.LineNo,
+			Colno:        frame.ColNo,
+			AbsolutePath: frame.AbsPath,
+			ContextLine:  frame.ContextLine,
+			PreContext:   frame.ContextPre,
+			PostContext:  frame.ContextPost,
+			InApp:        frame.InApp,
+		})
+	}
+
+	return exception
+}
+
+// newBreadcrumbs converts console entries into Sentry breadcrumbs.
+func newBreadcrumbs(entries []*models.LogEntry) *models.Breadcrumbs {
+	breadcrumbs := &models.Breadcrumbs{
+		Values: []*models.Breadcrumb{},
+	}
+
+	for _, entry := range entries {
+		breadcrumb := &models.Breadcrumb{
+			// Entry dates are JS timestamps in milliseconds
+			Timestamp: float64(entry.Date) / 1000,
+			Category:  "console",
+			Level:     string(entryLevel(entry.Type)),
+			Message:   entry.Message,
+			Data: map[string]interface{}{
+				"logger": entry.Type,
+			},
+		}
+		if entry.Objects != nil {
+			breadcrumb.Data["arguments"] = entry.Objects
+		}
+
+		breadcrumbs.Values = append(breadcrumbs.Values, breadcrumb)
+	}
+
+	return breadcrumbs
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/lavab/goji/web"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Weights of the frame and message similarities in the final score
+const (
+	frameWeight   = 0.7
+	messageWeight = 0.3
+)
+
+type SimilarIssue struct {
+	Issue   *models.Issue `json:"issue"`
+	Score   float64       `json:"score"`
+	Frames  float64       `json:"frames"`
+	Message float64       `json:"message"`
+}
+
+// similarity scores how likely two issues are duplicates. Similarities that
+// can't be computed because a side is empty are left out of the weighting.
+func similarity(a, b *models.Issue) *SimilarIssue {
+	si := &SimilarIssue{
+		Issue:   b,
+		Frames:  frameSimilarity(a.Frames, b.Frames),
+		Message: messageSimilarity(a.Message, b.Message),
+	}
+
+	weights := 0.0
+	if len(a.Frames) > 0 && len(b.Frames) > 0 {
+		si.Score += frameWeight * si.Frames
+		weights += frameWeight
+	}
+	if len(shingles(normalizeMessage(a.Message))) > 0 && len(shingles(normalizeMessage(b.Message))) > 0 {
+		si.Score += messageWeight * si.Message
+		weights += messageWeight
+	}
+	if weights > 0 {
+		si.Score /= weights
+	}
+
+	return si
+}
+
+// frameSimilarity returns 1 - the normalized edit distance between two frame
+// lists, so that stacks differing by a few frames still score high.
+func frameSimilarity(a, b []string) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	// Levenshtein distance over whole frames, two rows at a time
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	max := len(a)
+	if len(b) > max {
+		max = len(b)
+	}
+
+	return 1 - float64(prev[len(b)])/float64(max)
+}
+
+// messageSimilarity is the Jaccard index of the messages' word shingles.
+func messageSimilarity(a, b string) float64 {
+	as, bs := shingles(normalizeMessage(a)), shingles(normalizeMessage(b))
+	if len(as) == 0 || len(bs) == 0 {
+		return 0
+	}
+
+	common := 0
+	for s := range as {
+		if bs[s] {
+			common++
+		}
+	}
+
+	return float64(common) / float64(len(as)+len(bs)-common)
+}
+
+// shingles splits a normalized message into a set of word bigrams, ignoring
+// case, placeholders and anything but letters.
+func shingles(message string) map[string]bool {
+	for _, normalizer := range messageNormalizers {
+		message = strings.Replace(message, normalizer.Placeholder, " ", -1)
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(message), func(c rune) bool {
+		return !unicode.IsLetter(c)
+	})
+
+	set := map[string]bool{}
+	if len(words) == 1 {
+		set[words[0]] = true
+	}
+	for i := 0; i+1 < len(words); i++ {
+		set[words[i]+" "+words[i+1]] = true
+	}
+
+	return set
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// GET /issues/:id/similar?limit=10&threshold=0.5 - ranked likely duplicates
+func similarIssues(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	limit := 10
+	if value := req.URL.Query().Get("limit"); value != "" {
+		x, err := strconv.Atoi(value)
+		if err != nil || x < 1 {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid limit"))
+			return
+		}
+		limit = x
+	}
+	threshold := 0.5
+	if value := req.URL.Query().Get("threshold"); value != "" {
+		x, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			w.WriteHeader(400)
+			w.Write([]byte("Invalid threshold"))
+			return
+		}
+		threshold = x
+	}
+
+	issue, ok := loadIssue(c, w)
+	if !ok {
+		return
+	}
+
+	// Only the scored fields, ignored issues aren't worth suggesting
+	cursor, err := r.DB(*rethinkdbDatabase).Table("issues").Filter(
+		r.Row.Field("status").Ne(models.IssueIgnored),
+	).Pluck("id", "message", "frames", "fingerprints").Run(session)
+	if err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	var candidates []*models.Issue
+	if err := cursor.All(&candidates); err != nil {
+		w.WriteHeader(500)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	result := []*SimilarIssue{}
+	for _, candidate := range candidates {
+		if candidate.ID == issue.ID {
+			continue
+		}
+
+		si := similarity(issue, candidate)
+		if si.Score < threshold {
+			continue
+		}
+
+		result = append(result, si)
+	}
+
+	sort.Sort(byScore(result))
+	if len(result) > limit {
+		result = result[:limit]
+	}
+
+	// Load the whole issues of the results
+	if len(result) > 0 {
+		ids := []interface{}{}
+		for _, si := range result {
+			ids = append(ids, si.Issue.ID)
+		}
+		cursor, err := r.DB(*rethinkdbDatabase).Table("issues").GetAll(ids...).Run(session)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		var issues []*models.Issue
+		if err := cursor.All(&issues); err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+			return
+		}
+
+		byID := map[string]*models.Issue{}
+		for _, issue := range issues {
+			byID[issue.ID] = issue
+		}
+		for _, si := range result {
+			if issue, ok := byID[si.Issue.ID]; ok {
+				si.Issue = issue
+			}
+		}
+	}
+
+	writeJSON(w, result)
+}
+
+type byScore []*SimilarIssue
+
+func (s byScore) Len() int           { return len(s) }
+func (s byScore) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byScore) Less(i, j int) bool { return s[i].Score > s[j].Score }
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+func TestSimilarity(t *testing.T) {
+	frames := []string{"app.js:render", "app.js:update", "lib.js:dispatch"}
+
+	tests := []struct {
+		a, b     *models.Issue
+		expected float64
+	}{
+		// Nothing in common to compare
+		{
+			&models.Issue{Message: "Script error."},
+			&models.Issue{Message: "Out of memory"},
+			0,
+		},
+		{
+			&models.Issue{Message: "123"},
+			&models.Issue{Message: "456"},
+			0,
+		},
+		{
+			&models.Issue{Message: "", Frames: frames},
+			&models.Issue{Message: "", Frames: nil},
+			0,
+		},
+
+		// Only the messages can be compared
+		{
+			&models.Issue{Message: "Script error."},
+			&models.Issue{Message: "Script error."},
+			1,
+		},
+		{
+			&models.Issue{Message: "x is undefined", Frames: frames},
+			&models.Issue{Message: "x is undefined"},
+			1,
+		},
+
+		// Only the frames can be compared
+		{
+			&models.Issue{Message: "123", Frames: frames},
+			&models.Issue{Message: "456", Frames: frames},
+			1,
+		},
+
+		// Both
+		{
+			&models.Issue{Message: "x is undefined", Frames: frames},
+			&models.Issue{Message: "Out of memory", Frames: frames},
+			frameWeight,
+		},
+	}
+
+	for _, test := range tests {
+		if si := similarity(test.a, test.b); si.Score != test.expected {
+			t.Errorf("%q vs %q scored %v, expected %v", test.a.Message, test.b.Message, si.Score, test.expected)
+		}
+	}
+}
+
+func TestComponentSimilarities(t *testing.T) {
+	if s := messageSimilarity("123", "456"); s != 0 {
+		t.Errorf("Messages without words scored %v", s)
+	}
+	if s := messageSimilarity("Script error.", "Out of memory"); s != 0 {
+		t.Errorf("Different messages scored %v", s)
+	}
+	if s := frameSimilarity(nil, nil); s != 0 {
+		t.Errorf("Empty frame lists scored %v", s)
+	}
+	if s := frameSimilarity([]string{"a", "b", "c", "d"}, []string{"a", "b", "x", "d"}); s != 0.75 {
+		t.Errorf("Frame lists differing by one frame scored %v", s)
+	}
+}
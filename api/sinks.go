@@ -0,0 +1,540 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/syslog"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/Sirupsen/logrus/hooks/syslog"
+	r "github.com/dancannon/gorethink"
+	"github.com/lavab/raven-go"
+)
+
+// Sink is a destination of the processed events. Each delivery gets its own
+// copy of the packet.
+type Sink interface {
+	Send(packet *raven.Packet) error
+}
+
+// SinkConfig is an entry of the -sinks file. Only the options of the sink's
+// type are used.
+type SinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+
+	// Delivery timeout, eg. "5s", defaults to -delivery_timeout
+	Timeout string `json:"timeout"`
+
+	// Filters, all of them must match for an event to be sent
+	MinLevel     string   `json:"min_level"`
+	Environments []string `json:"environments"`
+	Message      string   `json:"message"`
+
+	// sentry and sentry_envelope
+	DSN string `json:"dsn"`
+
+	// sentry_envelope, attaches the console entries as console.log
+	Attachments bool `json:"attachments"`
+
+	// rethinkdb
+	Table string `json:"table"`
+
+	// file
+	Path     string `json:"path"`
+	MaxSize  int64  `json:"max_size"`
+	MaxFiles int    `json:"max_files"`
+
+	// webhook
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+
+	// syslog, an empty network and address use the local syslog
+	Network string `json:"network"`
+	Address string `json:"address"`
+	Tag     string `json:"tag"`
+}
+
+// outputSink is a configured sink along with its filters and breaker.
+type outputSink struct {
+	Name string
+	Sink Sink
+
+	minLevel     raven.Severity
+	environments map[string]bool
+	message      *regexp.Regexp
+	timeout      time.Duration
+	breaker      *circuitBreaker
+}
+
+// Configured sinks, events are sent to all the matching ones
+var sinks = []*outputSink{}
+
+// loadSinks sets up the sinks of a -sinks file. Without one, events go to
+// Sentry if a DSN is set.
+func loadSinks(path string) error {
+	configs := []*SinkConfig{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, &configs); err != nil {
+			return err
+		}
+	} else if *ravenDSN != "" {
+		configs = append(configs, &SinkConfig{
+			Name: "sentry",
+			Type: "sentry",
+			DSN:  *ravenDSN,
+		})
+	}
+
+	names := map[string]bool{}
+	for i, config := range configs {
+		if config.Name == "" {
+			config.Name = config.Type
+		}
+		if names[config.Name] {
+			return errors.New("Sink " + strconv.Itoa(i) + ": duplicate name " + config.Name)
+		}
+		names[config.Name] = true
+
+		sink, err := newOutputSink(config)
+		if err != nil {
+			return errors.New("Sink " + config.Name + ": " + err.Error())
+		}
+		sinks = append(sinks, sink)
+	}
+
+	return nil
+}
+
+func newOutputSink(config *SinkConfig) (*outputSink, error) {
+	out := &outputSink{
+		Name:         config.Name,
+		environments: map[string]bool{},
+	}
+
+	timeout, err := config.timeout()
+	if err != nil {
+		return nil, err
+	}
+	out.timeout = timeout
+
+	if config.MinLevel != "" {
+		level, err := parseSeverity(config.MinLevel)
+		if err != nil {
+			return nil, err
+		}
+		out.minLevel = level
+	}
+	for _, environment := range config.Environments {
+		out.environments[environment] = true
+	}
+	if config.Message != "" {
+		pattern, err := regexp.Compile(config.Message)
+		if err != nil {
+			return nil, err
+		}
+		out.message = pattern
+	}
+
+	switch config.Type {
+	case "sentry":
+		out.Sink, err = newSentrySink(config)
+	case "sentry_envelope":
+		out.Sink, err = newEnvelopeSink(config)
+	case "rethinkdb":
+		out.Sink, err = newRethinkSink(config)
+	case "file":
+		out.Sink, err = newFileSink(config)
+	case "stdout":
+		out.Sink = &stdoutSink{}
+	case "webhook":
+		out.Sink, err = newWebhookSink(config)
+	case "syslog":
+		out.Sink, err = newSyslogSink(config)
+	default:
+		err = errors.New("unknown type " + config.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	out.breaker = newCircuitBreaker(config.Name)
+	return out, nil
+}
+
+// accepts returns whether an event passes the sink's filters.
+func (out *outputSink) accepts(packet *raven.Packet) bool {
+	if out.minLevel != "" && severityOrder[packet.Level] < severityOrder[out.minLevel] {
+		return false
+	}
+	if len(out.environments) > 0 && !out.environments[packetTag(packet, "environment")] {
+		return false
+	}
+	if out.message != nil && !out.message.MatchString(packet.Message) {
+		return false
+	}
+
+	return true
+}
+
+// send delivers an event unless the sink's breaker is open, giving up on it
+// after the delivery timeout.
+func (out *outputSink) send(data []byte) error {
+	packet, err := decodePacket(data)
+	if err != nil {
+		return err
+	}
+
+	if !out.breaker.Allow() {
+		return errCircuitOpen
+	}
+
+	// Buffered so that a late delivery doesn't block
+	ch := make(chan error, 1)
+	go func() {
+		ch <- out.Sink.Send(packet)
+	}()
+
+	select {
+	case err = <-ch:
+	case <-time.After(out.timeout):
+		err = errors.New("Delivery to " + out.Name + " timed out")
+	}
+
+	out.breaker.Record(err)
+	return err
+}
+
+// timeout returns the delivery timeout of the sink.
+func (config *SinkConfig) timeout() (time.Duration, error) {
+	if config.Timeout == "" {
+		return *deliveryTimeout, nil
+	}
+
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return 0, err
+	}
+	if timeout <= 0 {
+		return 0, errors.New("the timeout must be positive")
+	}
+
+	return timeout, nil
+}
+
+func findSink(name string) *outputSink {
+	for _, sink := range sinks {
+		if sink.Name == name {
+			return sink
+		}
+	}
+
+	return nil
+}
+
+func packetTag(packet *raven.Packet, key string) string {
+	for _, tag := range packet.Tags {
+		if tag.Key == key {
+			return tag.Value
+		}
+	}
+
+	return ""
+}
+
+// sentrySink sends events to Sentry's legacy store endpoint.
+type sentrySink struct {
+	client *raven.Client
+}
+
+func newSentrySink(config *SinkConfig) (Sink, error) {
+	// Validated by newOutputSink
+	timeout, _ := config.timeout()
+
+	client, err := raven.NewClient(config.DSN, nil)
+	if err != nil {
+		return nil, err
+	}
+	client.Transport = &raven.HTTPTransport{
+		Http: http.Client{
+			Timeout: timeout,
+		},
+	}
+
+	return &sentrySink{client}, nil
+}
+
+func (s *sentrySink) Send(packet *raven.Packet) error {
+	_, ch := s.client.Capture(packet, nil)
+	return <-ch
+}
+
+// rethinkSink stores events in a RethinkDB table, keyed by their event ID.
+type rethinkSink struct {
+	table string
+}
+
+func newRethinkSink(config *SinkConfig) (Sink, error) {
+	if config.Table == "" {
+		config.Table = "events"
+	}
+	r.DB(*rethinkdbDatabase).TableCreate(config.Table).Exec(session)
+
+	return &rethinkSink{config.Table}, nil
+}
+
+func (s *rethinkSink) Send(packet *raven.Packet) error {
+	var event map[string]interface{}
+	if err := json.Unmarshal(packet.JSON(), &event); err != nil {
+		return err
+	}
+	event["id"] = packet.EventID
+
+	// Retries replace the previous attempts
+	return r.DB(*rethinkdbDatabase).Table(s.table).Insert(event, r.InsertOpts{
+		Conflict: "replace",
+	}).Exec(session)
+}
+
+// fileSink appends events to a newline-delimited JSON file, rotating it to
+// path.1, path.2, ... once it reaches the maximal size.
+type fileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+
+	file *os.File
+	size int64
+	lock sync.Mutex
+}
+
+func newFileSink(config *SinkConfig) (Sink, error) {
+	if config.Path == "" {
+		return nil, errors.New("a path is required")
+	}
+	if config.MaxFiles == 0 {
+		config.MaxFiles = 5
+	}
+
+	s := &fileSink{
+		path:     config.Path,
+		maxSize:  config.MaxSize,
+		maxFiles: config.MaxFiles,
+	}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	s.file = file
+	s.size = info.Size()
+	return nil
+}
+
+func (s *fileSink) rotate() error {
+	s.file.Close()
+
+	for i := s.maxFiles - 1; i > 0; i-- {
+		os.Rename(s.path+"."+strconv.Itoa(i), s.path+"."+strconv.Itoa(i+1))
+	}
+	if err := os.Rename(s.path, s.path+".1"); err != nil {
+		return err
+	}
+
+	return s.open()
+}
+
+func (s *fileSink) Send(packet *raven.Packet) error {
+	line := append(packet.JSON(), '\n')
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.maxSize > 0 && s.size > 0 && s.size+int64(len(line)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// stdoutSink prints events as newline-delimited JSON.
+type stdoutSink struct {
+	lock sync.Mutex
+}
+
+func (s *stdoutSink) Send(packet *raven.Packet) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, err := os.Stdout.Write(append(packet.JSON(), '\n'))
+	return err
+}
+
+// webhookSink posts events as JSON to a URL.
+type webhookSink struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func newWebhookSink(config *SinkConfig) (Sink, error) {
+	// Validated by newOutputSink
+	timeout, _ := config.timeout()
+
+	if config.URL == "" {
+		return nil, errors.New("a URL is required")
+	}
+
+	return &webhookSink{
+		url:     config.URL,
+		headers: config.Headers,
+		client: &http.Client{
+			Timeout: timeout,
+		},
+	}, nil
+}
+
+func (s *webhookSink) Send(packet *raven.Packet) error {
+	req, err := http.NewRequest("POST", s.url, bytes.NewReader(packet.JSON()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range s.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook returned %d", resp.StatusCode)
+	}
+
+	return nil
+}
+
+// syslogSink logs a line per event to syslog.
+type syslogSink struct {
+	logger *logrus.Logger
+	hook   *logrus_syslog.SyslogHook
+}
+
+// Syslog levels of the Sentry severities
+var logrusLevels = map[raven.Severity]logrus.Level{
+	raven.DEBUG:   logrus.DebugLevel,
+	raven.INFO:    logrus.InfoLevel,
+	raven.WARNING: logrus.WarnLevel,
+	raven.ERROR:   logrus.ErrorLevel,
+	raven.FATAL:   logrus.FatalLevel,
+}
+
+func newSyslogSink(config *SinkConfig) (Sink, error) {
+	if config.Tag == "" {
+		config.Tag = "lavatrace"
+	}
+
+	hook, err := logrus_syslog.NewSyslogHook(config.Network, config.Address, syslog.LOG_INFO|syslog.LOG_USER, config.Tag)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logrus.New()
+	logger.Formatter = &logrus.JSONFormatter{}
+
+	return &syslogSink{logger, hook}, nil
+}
+
+func (s *syslogSink) Send(packet *raven.Packet) error {
+	entry := logrus.NewEntry(s.logger)
+	entry.Time = time.Time(packet.Timestamp)
+	entry.Message = packet.Message
+	entry.Level = logrus.ErrorLevel
+	if level, ok := logrusLevels[packet.Level]; ok {
+		entry.Level = level
+	}
+
+	entry.Data["event_id"] = packet.EventID
+	entry.Data["culprit"] = packet.Culprit
+	entry.Data["release"] = packet.Release
+	for _, tag := range packet.Tags {
+		entry.Data["tags."+tag.Key] = tag.Value
+	}
+
+	// Fired directly to get the delivery errors
+	return s.hook.Fire(entry)
+}
+
+// deliverPacket sends an event to all the matching sinks. With a spool,
+// events that couldn't be delivered, including the ones held back by a
+// circuit breaker, are retried in the background and only spooling errors
+// are returned.
+func deliverPacket(packet *raven.Packet) error {
+	data := packet.JSON()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(sinks))
+	for _, sink := range sinks {
+		if !sink.accepts(packet) {
+			continue
+		}
+
+		wg.Add(1)
+		go func(sink *outputSink) {
+			defer wg.Done()
+
+			if *spoolDir != "" {
+				errs <- spoolPacket(sink, packet.EventID, data)
+				return
+			}
+
+			if err := sink.send(data); err != nil {
+				errs <- errors.New("Delivery to " + sink.Name + " failed: " + err.Error())
+			}
+		}(sink)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
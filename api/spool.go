@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cenkalti/backoff"
+	"github.com/lavab/goji/web"
+	"github.com/lavab/raven-go"
+)
+
+// The spool is an append-only log of the packets being delivered to the
+// sinks. A packet is added before its first delivery attempt and marked as
+// done once it's delivered or purged, so that the pending ones can be
+// replayed after a restart.
+const spoolFile = "spool.ndjson"
+
+// Spool operations
+const (
+	spoolAdd  = "add"
+	spoolDone = "done"
+)
+
+// Done records after which the spool is compacted, unless there are more
+// pending packets to rewrite
+const spoolCompactThreshold = 1000
+
+type spoolRecord struct {
+	Op     string          `json:"op"`
+	ID     string          `json:"id"`
+	Sink   string          `json:"sink,omitempty"`
+	Date   time.Time       `json:"date,omitempty"`
+	Packet json.RawMessage `json:"packet,omitempty"`
+}
+
+// spoolEntry is a packet that hasn't been delivered to a sink yet.
+type spoolEntry struct {
+	ID        string          `json:"id"`
+	Sink      string          `json:"sink"`
+	Date      time.Time       `json:"date"`
+	Attempts  int             `json:"attempts"`
+	NextRetry time.Time       `json:"next_retry"`
+	LastError string          `json:"last_error,omitempty"`
+	Packet    json.RawMessage `json:"packet"`
+
+	// Set while a delivery attempt is running
+	sending bool
+	backOff *backoff.ExponentialBackOff
+}
+
+// Spool entries by sink and event ID
+var (
+	spoolEntries = map[string]*spoolEntry{}
+	spoolWriter  *os.File
+	spoolLock    sync.Mutex
+
+	// Done records written since the last compaction
+	spoolDoneRecords int
+)
+
+// openSpool replays the spool and starts retrying the pending packets.
+func openSpool() error {
+	if err := loadSpool(); err != nil {
+		return err
+	}
+
+	go retrySpool()
+	return nil
+}
+
+// loadSpool reads the pending packets of the spool, compacting it down to
+// them.
+func loadSpool() error {
+	if err := os.MkdirAll(*spoolDir, 0700); err != nil {
+		return err
+	}
+	path := filepath.Join(*spoolDir, spoolFile)
+
+	file, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if file != nil {
+		// Packets have no size limit, so neither have the lines
+		reader := bufio.NewReader(file)
+		for {
+			line, err := reader.ReadBytes('\n')
+			if err != nil && err != io.EOF {
+				file.Close()
+				return err
+			}
+			if len(line) == 0 {
+				break
+			}
+
+			var record *spoolRecord
+			if err := json.Unmarshal(line, &record); err != nil || record == nil {
+				// Most likely a partial write before a crash
+				log.Printf("Skipping an invalid spool record of %d bytes", len(line))
+				continue
+			}
+
+			// Sentry was the only destination before the sinks
+			if record.Sink == "" {
+				record.Sink = "sentry"
+			}
+
+			switch record.Op {
+			case spoolAdd:
+				entry := &spoolEntry{
+					ID:      record.ID,
+					Sink:    record.Sink,
+					Date:    record.Date,
+					Packet:  record.Packet,
+					backOff: newSpoolBackOff(),
+				}
+				spoolEntries[entry.key()] = entry
+			case spoolDone:
+				delete(spoolEntries, record.Sink+"/"+record.ID)
+			}
+		}
+		file.Close()
+	}
+
+	if err := compactSpool(); err != nil {
+		return err
+	}
+	if len(spoolEntries) > 0 {
+		log.Printf("Replaying %d spooled packets", len(spoolEntries))
+	}
+
+	return nil
+}
+
+func newSpoolBackOff() *backoff.ExponentialBackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = time.Second
+	// Expiry is checked against the date of the packets, which survives
+	// restarts
+	b.MaxElapsedTime = 0
+	b.Reset()
+	return b
+}
+
+// compactSpool rewrites the spool with only the pending packets.
+func compactSpool() error {
+	path := filepath.Join(*spoolDir, spoolFile)
+
+	temp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(temp)
+	for _, entry := range spoolEntries {
+		if err := encoder.Encode(&spoolRecord{
+			Op:     spoolAdd,
+			ID:     entry.ID,
+			Sink:   entry.Sink,
+			Date:   entry.Date,
+			Packet: entry.Packet,
+		}); err != nil {
+			temp.Close()
+			return err
+		}
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	temp.Close()
+
+	if spoolWriter != nil {
+		spoolWriter.Close()
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+
+	spoolDoneRecords = 0
+	spoolWriter, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	return err
+}
+
+func appendSpool(record *spoolRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := spoolWriter.Write(append(data, '\n')); err != nil {
+		return err
+	}
+
+	// Packets must survive a crash, losing a done record only means a
+	// duplicate delivery
+	if record.Op == spoolAdd {
+		return spoolWriter.Sync()
+	}
+
+	return nil
+}
+
+func (entry *spoolEntry) key() string {
+	return entry.Sink + "/" + entry.ID
+}
+
+// spoolPacket spools an event for a sink and makes the first delivery
+// attempt, leaving the retries to the background.
+func spoolPacket(sink *outputSink, id string, data []byte) error {
+	entry := &spoolEntry{
+		ID:      id,
+		Sink:    sink.Name,
+		Date:    time.Now(),
+		Packet:  data,
+		sending: true,
+		backOff: newSpoolBackOff(),
+	}
+
+	spoolLock.Lock()
+	err := appendSpool(&spoolRecord{
+		Op:     spoolAdd,
+		ID:     entry.ID,
+		Sink:   entry.Sink,
+		Date:   entry.Date,
+		Packet: entry.Packet,
+	})
+	if err == nil {
+		spoolEntries[entry.key()] = entry
+	}
+	spoolLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	finishDelivery(entry, sink.send(data))
+
+	return nil
+}
+
+// finishDelivery records the outcome of a delivery attempt.
+func finishDelivery(entry *spoolEntry, err error) {
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	entry.sending = false
+
+	// Purged in the meantime
+	if _, ok := spoolEntries[entry.key()]; !ok {
+		return
+	}
+
+	// Not an attempt, retried as soon as the breaker lets a probe through
+	if err == errCircuitOpen {
+		if entry.LastError == "" {
+			entry.LastError = err.Error()
+		}
+		return
+	}
+
+	entry.Attempts++
+
+	if err == nil {
+		removeSpoolEntry(entry)
+		return
+	}
+
+	entry.LastError = err.Error()
+	entry.NextRetry = time.Now().Add(entry.backOff.NextBackOff())
+	log.Print("Spooled packet " + entry.ID + " after a failed delivery to " + entry.Sink + ": " + err.Error())
+}
+
+// removeSpoolEntry marks a packet as done, compacting the spool once it's
+// mostly made of delivered packets. spoolLock must be held.
+func removeSpoolEntry(entry *spoolEntry) {
+	delete(spoolEntries, entry.key())
+
+	if err := appendSpool(&spoolRecord{
+		Op:   spoolDone,
+		ID:   entry.ID,
+		Sink: entry.Sink,
+	}); err != nil {
+		log.Print("Unable to write to the spool: " + err.Error())
+	}
+	spoolDoneRecords++
+
+	if spoolDoneRecords >= spoolCompactThreshold && spoolDoneRecords >= len(spoolEntries) {
+		if err := compactSpool(); err != nil {
+			log.Print("Unable to compact the spool: " + err.Error())
+		}
+	}
+}
+
+// retrySpool redelivers the due packets, dropping the expired ones.
+func retrySpool() {
+	for range time.Tick(time.Second) {
+		now := time.Now()
+		due := []*spoolEntry{}
+
+		spoolLock.Lock()
+		for _, entry := range spoolEntries {
+			if entry.sending || entry.NextRetry.After(now) {
+				continue
+			}
+
+			if now.Sub(entry.Date) > *spoolMaxAge {
+				log.Print("Dropping spooled packet " + entry.ID + " for " + entry.Sink + " after " + entry.LastError)
+				removeSpoolEntry(entry)
+				continue
+			}
+
+			// The sink was removed from the config since
+			if findSink(entry.Sink) == nil {
+				log.Print("Dropping spooled packet " + entry.ID + " for unknown sink " + entry.Sink)
+				removeSpoolEntry(entry)
+				continue
+			}
+
+			entry.sending = true
+			due = append(due, entry)
+		}
+		spoolLock.Unlock()
+
+		// Sinks waiting for their breaker to let a probe through
+		blocked := map[string]bool{}
+		for _, entry := range due {
+			if blocked[entry.Sink] {
+				finishDelivery(entry, errCircuitOpen)
+				continue
+			}
+
+			err := findSink(entry.Sink).send(entry.Packet)
+			finishDelivery(entry, err)
+			if err == errCircuitOpen {
+				blocked[entry.Sink] = true
+			}
+		}
+	}
+}
+
+// rawInterface is a Sentry interface restored from a spooled packet.
+type rawInterface struct {
+	class string
+	data  json.RawMessage
+}
+
+func (i *rawInterface) Class() string { return i.class }
+
+func (i *rawInterface) MarshalJSON() ([]byte, error) { return i.data, nil }
+
+// Top-level attributes of raven.Packet, the other ones are interfaces
+var packetAttributes = map[string]bool{
+	"message": true, "event_id": true, "project": true, "timestamp": true,
+	"level": true, "logger": true, "platform": true, "culprit": true,
+	"server_name": true, "release": true, "tags": true, "modules": true,
+	"extra": true,
+}
+
+// decodePacket restores a packet serialized with Packet.JSON.
+func decodePacket(data json.RawMessage) (*raven.Packet, error) {
+	var packet *raven.Packet
+	if err := json.Unmarshal(data, &packet); err != nil {
+		return nil, err
+	}
+	if packet == nil {
+		return nil, errors.New("Empty packet")
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return nil, err
+	}
+	for key, value := range fields {
+		if !packetAttributes[key] {
+			packet.Interfaces = append(packet.Interfaces, &rawInterface{
+				class: key,
+				data:  value,
+			})
+		}
+	}
+
+	return packet, nil
+}
+
+// GET /spool - packets waiting to be delivered to the sinks
+func listSpool(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	// Copied as the entries are updated in place
+	spoolLock.Lock()
+	result := []spoolEntry{}
+	for _, entry := range spoolEntries {
+		result = append(result, *entry)
+	}
+	spoolLock.Unlock()
+
+	writeJSON(w, result)
+}
+
+// DELETE /spool - drops all the spooled packets
+func purgeSpool(w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	spoolLock.Lock()
+	for _, entry := range spoolEntries {
+		removeSpoolEntry(entry)
+	}
+	spoolLock.Unlock()
+
+	w.Write([]byte("Success"))
+}
+
+// DELETE /spool/:id - drops a spooled packet for all the sinks
+func deleteSpoolEntry(c web.C, w http.ResponseWriter, req *http.Request) {
+	if !checkToken(w, req) {
+		return
+	}
+
+	spoolLock.Lock()
+	defer spoolLock.Unlock()
+
+	found := false
+	for _, entry := range spoolEntries {
+		if entry.ID == c.URLParams["id"] {
+			removeSpoolEntry(entry)
+			found = true
+		}
+	}
+	if !found {
+		w.WriteHeader(404)
+		w.Write([]byte("Packet not found"))
+		return
+	}
+
+	w.Write([]byte("Success"))
+}
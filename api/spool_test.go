@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(dir string) {
+		*spoolDir = dir
+		spoolWriter.Close()
+		spoolWriter = nil
+		spoolEntries = map[string]*spoolEntry{}
+		spoolDoneRecords = 0
+	}(*spoolDir)
+	*spoolDir = dir
+
+	// Frames repeated across causes make packets larger than reports
+	large, _ := json.Marshal(strings.Repeat("x", *maxReportSize*5))
+	record := func(op, id string, packet []byte) string {
+		data, _ := json.Marshal(&spoolRecord{
+			Op:     op,
+			ID:     id,
+			Sink:   "sentry",
+			Date:   time.Now(),
+			Packet: packet,
+		})
+		return string(data) + "\n"
+	}
+	spool := record(spoolAdd, "large", large) +
+		`{"op": "add", "id": "partial` + "\n" +
+		record(spoolAdd, "delivered", []byte(`{}`)) +
+		record(spoolAdd, "pending", []byte(`{}`)) +
+		record(spoolDone, "delivered", nil)
+	path := filepath.Join(dir, spoolFile)
+	if err := ioutil.WriteFile(path, []byte(spool), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := loadSpool(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(spoolEntries) != 2 || spoolEntries["sentry/large"] == nil || spoolEntries["sentry/pending"] == nil {
+		t.Fatalf("Unexpected entries %v", spoolEntries)
+	}
+	if len(spoolEntries["sentry/large"].Packet) != len(large) {
+		t.Error("The large packet was truncated")
+	}
+
+	// Compacted down to the pending packets
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 2 {
+		t.Errorf("Expected 2 records after the compaction, got %d", lines)
+	}
+
+	// Delivering every packet doesn't compact the spool each time
+	for _, entry := range spoolEntries {
+		removeSpoolEntry(entry)
+	}
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte("\n")); lines != 4 || spoolDoneRecords != 2 {
+		t.Errorf("Expected 4 records and 2 done ones, got %d and %d", lines, spoolDoneRecords)
+	}
+}
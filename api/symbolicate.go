@@ -0,0 +1,158 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// buildLog transforms a report into a Log with symbolicated frames.
+func buildLog(report *models.Report) (*models.Log, error) {
+	lo := &models.Log{
+		CommitID: report.CommitID,
+		Version:  report.Version,
+		Assets:   report.Assets,
+		Entries:  []*models.LogEntry{},
+	}
+
+	// Transform entries into exceptions
+	for _, entry := range report.Entries {
+		en, err := buildEntry(report, entry, 0)
+		if err != nil {
+			return nil, err
+		}
+
+		// Put entry into entries
+		lo.Entries = append(lo.Entries, en)
+	}
+
+	return lo, nil
+}
+
+// Maximal nesting of error causes and aggregated errors
+const maxCauseDepth = 10
+
+// buildEntry symbolicates an entry along with its causes and inner errors.
+func buildEntry(report *models.Report, entry *models.Entry, depth int) (*models.LogEntry, error) {
+	if depth > maxCauseDepth {
+		return nil, badRequest("Too deeply nested error causes")
+	}
+
+	// Prepare a new Entry
+	en := &models.LogEntry{
+		Date:    entry.Date,
+		Type:    entry.Type,
+		Message: entry.Message,
+		Objects: entry.Objects,
+		Frames:  []*models.LogFrame{},
+	}
+
+	frames, err := symbolicate(report, entry.Stacktrace)
+	if err != nil {
+		return nil, err
+	}
+	en.Frames = frames
+
+	if entry.Cause != nil {
+		en.Cause, err = buildEntry(report, entry.Cause, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, inner := range entry.Errors {
+		ie, err := buildEntry(report, inner, depth+1)
+		if err != nil {
+			return nil, err
+		}
+
+		en.Errors = append(en.Errors, ie)
+	}
+
+	return en, nil
+}
+
+// symbolicate resolves a stacktrace against the report's commit and assets.
+func symbolicate(report *models.Report, stacktrace string) ([]*models.LogFrame, error) {
+	frames := []*models.LogFrame{}
+
+	// Errors without a stack, eg. most causes
+	if stacktrace == "" {
+		return frames, nil
+	}
+
+	// Stacktrace is a string with format:
+	//   fileIndex:line:column
+	for _, part := range strings.Split(stacktrace, ";") {
+		// Parse each call
+		call := strings.Split(part, ":")
+		if len(call) < 3 {
+			return nil, badRequest("Invalid stacktrace")
+		}
+
+		// Parse the fields
+		fileIndex := call[0]
+		lineNo, err := strconv.Atoi(call[1])
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+		columnNo, err := strconv.Atoi(call[2])
+		if err != nil {
+			return nil, badRequest(err.Error())
+		}
+
+		// First case - we don't know the source
+		switch fileIndex {
+		case "/":
+			frames = append(frames, &models.LogFrame{
+				Filename: "unknown",
+				Name:     "unknown",
+				LineNo:   lineNo,
+				ColNo:    columnNo,
+				InApp:    true,
+			})
+		case "native":
+			frames = append(frames, &models.LogFrame{
+				Filename: "native",
+				Name:     "native",
+				LineNo:   lineNo,
+				ColNo:    columnNo,
+				InApp:    false,
+			})
+		default:
+			// Convert file index to an int
+			fii, err := strconv.Atoi(fileIndex)
+			if err != nil {
+				return nil, badRequest(err.Error())
+			}
+
+			// Map index to file path
+			if fii < 0 || len(report.Assets) < fii+1 {
+				return nil, badRequest("Invalid asset ID")
+			}
+			asset := report.Assets[fii]
+
+			// Get the asset's filename
+			filename := path.Base(asset) + ".map"
+
+			// Map the data
+			mapping, err := getMapping(report.CommitID, filename, lineNo, columnNo)
+			if err != nil {
+				return nil, err
+			}
+
+			// Append it to the stacktrace
+			frames = append(frames, &models.LogFrame{
+				Filename: mapping.OriginalFile,
+				Name:     mapping.OriginalName,
+				LineNo:   mapping.OriginalLine,
+				ColNo:    mapping.OriginalColumn,
+				InApp:    true,
+				AbsPath:  asset,
+			})
+		}
+	}
+
+	return frames, nil
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// localizedMessages maps localized browser error templates to their English
+// counterpart. '%s' matches a quoted argument in any quote style used by the
+// browsers, %s matches a bare one.
+var localizedMessages = []struct {
+	Lang     string
+	Template string
+	English  string
+}{
+	// JavaScriptCore (Safari)
+	{"fr", "undefined n'est pas un objet (évaluation de '%s')", "undefined is not an object (evaluating '%s')"},
+	{"fr", "null n'est pas un objet (évaluation de '%s')", "null is not an object (evaluating '%s')"},
+	{"fr", "%s n'est pas une fonction", "%s is not a function"},
+	{"de", "undefined ist kein Objekt (Auswertung von '%s')", "undefined is not an object (evaluating '%s')"},
+	{"de", "null ist kein Objekt (Auswertung von '%s')", "null is not an object (evaluating '%s')"},
+	{"de", "%s ist keine Funktion", "%s is not a function"},
+	{"es", "undefined no es un objeto (evaluando '%s')", "undefined is not an object (evaluating '%s')"},
+	{"es", "null no es un objeto (evaluando '%s')", "null is not an object (evaluating '%s')"},
+	{"es", "%s no es una función", "%s is not a function"},
+	{"it", "undefined non è un oggetto (valutazione di '%s')", "undefined is not an object (evaluating '%s')"},
+	{"it", "null non è un oggetto (valutazione di '%s')", "null is not an object (evaluating '%s')"},
+	{"pt", "undefined não é um objeto (avaliando '%s')", "undefined is not an object (evaluating '%s')"},
+	{"pt", "null não é um objeto (avaliando '%s')", "null is not an object (evaluating '%s')"},
+
+	// V8 and SpiderMonkey builds with localized messages
+	{"de", "Kann Eigenschaft '%s' von undefined nicht lesen", "Cannot read property '%s' of undefined"},
+	{"de", "Kann Eigenschaft '%s' von null nicht lesen", "Cannot read property '%s' of null"},
+	{"de", "Eigenschaft '%s' von undefined kann nicht gelesen werden", "Cannot read property '%s' of undefined"},
+	{"de", "%s ist nicht definiert", "%s is not defined"},
+	{"fr", "Impossible de lire la propriété '%s' de undefined", "Cannot read property '%s' of undefined"},
+	{"fr", "Impossible de lire la propriété '%s' de null", "Cannot read property '%s' of null"},
+	{"fr", "%s n'est pas défini", "%s is not defined"},
+	{"es", "No se puede leer la propiedad '%s' de undefined", "Cannot read property '%s' of undefined"},
+	{"es", "%s no está definido", "%s is not defined"},
+
+	// Chakra (Internet Explorer, legacy Edge)
+	{"fr", "Impossible d'obtenir la propriété '%s' d'une référence null ou non définie", "Unable to get property '%s' of undefined or null reference"},
+	{"fr", "L'objet ne gère pas la propriété ou la méthode '%s'", "Object doesn't support property or method '%s'"},
+	{"fr", "'%s' est indéfini", "'%s' is undefined"},
+	{"fr", "Accès refusé.", "Access is denied."},
+	{"de", "Die Eigenschaft '%s' eines undefinierten oder Nullverweises kann nicht abgerufen werden.", "Unable to get property '%s' of undefined or null reference"},
+	{"de", "Das Objekt unterstützt die Eigenschaft oder Methode '%s' nicht.", "Object doesn't support property or method '%s'"},
+	{"de", "'%s' ist undefiniert", "'%s' is undefined"},
+	{"de", "Zugriff verweigert", "Access is denied."},
+	{"es", "No se puede obtener la propiedad '%s' de referencia nula o sin definir", "Unable to get property '%s' of undefined or null reference"},
+	{"es", "El objeto no acepta la propiedad o el método '%s'", "Object doesn't support property or method '%s'"},
+	{"es", "'%s' no está definido", "'%s' is undefined"},
+	{"es", "Acceso denegado.", "Access is denied."},
+	{"it", "Impossibile recuperare la proprietà '%s' di un riferimento nullo o non definito", "Unable to get property '%s' of undefined or null reference"},
+	{"it", "L'oggetto non supporta la proprietà o il metodo '%s'", "Object doesn't support property or method '%s'"},
+	{"it", "'%s' non è definito", "'%s' is undefined"},
+	{"it", "Accesso negato.", "Access is denied."},
+	{"pt", "Não é possível obter a propriedade '%s' de referência indefinida ou nula", "Unable to get property '%s' of undefined or null reference"},
+	{"pt", "O objeto não oferece suporte à propriedade ou método '%s'", "Object doesn't support property or method '%s'"},
+	{"pt", "'%s' não está definido", "'%s' is undefined"},
+	{"pt", "Acesso negado.", "Access is denied."},
+	{"nl", "Kan eigenschap '%s' van een niet-gedefinieerde verwijzing of een verwijzing naar een lege waarde niet ophalen", "Unable to get property '%s' of undefined or null reference"},
+	{"nl", "Het object ondersteunt de eigenschap of methode '%s' niet", "Object doesn't support property or method '%s'"},
+	{"nl", "'%s' is niet gedefinieerd", "'%s' is undefined"},
+	{"pl", "Nie można pobrać właściwości '%s' odwołania niezdefiniowanego lub o wartości null", "Unable to get property '%s' of undefined or null reference"},
+	{"pl", "Obiekt nie obsługuje właściwości lub metody '%s'", "Object doesn't support property or method '%s'"},
+	{"ru", "Не удалось получить свойство '%s' ссылки, значение которой не определено или является NULL", "Unable to get property '%s' of undefined or null reference"},
+	{"ru", "Объект не поддерживает свойство или метод '%s'", "Object doesn't support property or method '%s'"},
+	{"ru", "'%s' не определено", "'%s' is undefined"},
+}
+
+// Quote styles used around arguments by the localized messages
+const (
+	openQuotes  = `["'«„“‘‚]\s?`
+	closeQuotes = `\s?["'»“”’‘]`
+)
+
+type messageTranslation struct {
+	Lang    string
+	Pattern *regexp.Regexp
+	English string
+}
+
+var messageTranslations = compileTranslations()
+
+func compileTranslations() []*messageTranslation {
+	result := []*messageTranslation{}
+
+	// Bare arguments also match quoted ones, so quoted templates go first
+	for _, quoted := range []bool{true, false} {
+		for _, lm := range localizedMessages {
+			if strings.Contains(lm.Template, "'%s'") != quoted {
+				continue
+			}
+
+			pattern := regexp.QuoteMeta(strings.TrimSuffix(lm.Template, "."))
+			pattern = strings.Replace(pattern, "'%s'", "\x00", -1)
+			pattern = strings.Replace(pattern, "'", "['’]", -1)
+			pattern = strings.Replace(pattern, "%s", `(\S+?)`, -1)
+			pattern = strings.Replace(pattern, "\x00", openQuotes+"(.+?)"+closeQuotes, -1)
+
+			// Messages are often prefixed with the error type
+			result = append(result, &messageTranslation{
+				Lang:    lm.Lang,
+				Pattern: regexp.MustCompile(`^((?:\w*Error: )?)` + pattern + `\.?$`),
+				English: lm.English,
+			})
+		}
+	}
+
+	return result
+}
+
+// translateMessage maps a localized browser error message to canonical
+// English. It returns the message's language or "" if it's not a known
+// localized message.
+func translateMessage(message string) (string, string) {
+	for _, mt := range messageTranslations {
+		match := mt.Pattern.FindStringSubmatch(message)
+		if match == nil {
+			continue
+		}
+
+		english := mt.English
+		for _, arg := range match[2:] {
+			english = strings.Replace(english, "%s", arg, 1)
+		}
+
+		return match[1] + english, mt.Lang
+	}
+
+	return message, ""
+}
+
+// translateLog translates the log's messages into English, keeping the
+// originals.
+func translateLog(lo *models.Log) {
+	eachEntry(lo, func(entry *models.LogEntry) {
+		english, lang := translateMessage(entry.Message)
+		if lang == "" {
+			return
+		}
+
+		if entry.OriginalMessage == "" {
+			entry.OriginalMessage = entry.Message
+		}
+		entry.Message = english
+	})
+}
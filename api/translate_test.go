@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTranslateMessage(t *testing.T) {
+	tests := []struct {
+		message, expected, lang string
+	}{
+		{"'x' no está definido", "'x' is undefined", "es"},
+		{"x no está definido", "x is not defined", "es"},
+		{"ReferenceError: 'x' no está definido", "ReferenceError: 'x' is undefined", "es"},
+		{"TypeError: undefined n'est pas un objet (évaluation de 'a.b')", "TypeError: undefined is not an object (evaluating 'a.b')", "fr"},
+		{"TypeError: undefined n’est pas un objet (évaluation de « a.b »)", "TypeError: undefined is not an object (evaluating 'a.b')", "fr"},
+		{"Kann Eigenschaft „length“ von undefined nicht lesen", "Cannot read property 'length' of undefined", "de"},
+		{"Accès refusé", "Access is denied.", "fr"},
+		{"x is not defined", "x is not defined", ""},
+		{"Something went wrong", "Something went wrong", ""},
+	}
+
+	for _, test := range tests {
+		message, lang := translateMessage(test.message)
+		if message != test.expected || lang != test.lang {
+			t.Errorf("translateMessage(%q) = %q, %q, expected %q, %q", test.message, message, lang, test.expected, test.lang)
+		}
+	}
+}
+
+// Every template has to translate back to its own English message.
+func TestTranslateTemplates(t *testing.T) {
+	fill := func(template string) string {
+		return strings.Replace(strings.Replace(template, "'%s'", "'arg'", -1), "%s", "arg", -1)
+	}
+
+	for _, lm := range localizedMessages {
+		message, lang := translateMessage(fill(lm.Template))
+		if expected := fill(lm.English); message != expected || lang != lm.Lang {
+			t.Errorf("Template %q (%s) translated to %q (%s), expected %q", lm.Template, lm.Lang, message, lang, expected)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Browsers in order of precedence, as most of them also claim to be Chrome,
+// Safari or Mozilla
+var browserPatterns = []struct {
+	Name    string
+	Pattern *regexp.Regexp
+}{
+	{"Edge", regexp.MustCompile(`Edg(?:e|A|iOS)?/([\d.]+)`)},
+	{"Opera", regexp.MustCompile(`(?:OPR|Opera)/([\d.]+)`)},
+	{"Samsung Internet", regexp.MustCompile(`SamsungBrowser/([\d.]+)`)},
+	{"Yandex", regexp.MustCompile(`YaBrowser/([\d.]+)`)},
+	{"Firefox", regexp.MustCompile(`(?:Firefox|FxiOS)/([\d.]+)`)},
+	{"Chrome", regexp.MustCompile(`(?:Chrome|CriOS)/([\d.]+)`)},
+	{"Internet Explorer", regexp.MustCompile(`(?:MSIE |Trident/.*rv:)([\d.]+)`)},
+	{"Safari", regexp.MustCompile(`Version/([\d.]+).*Safari/`)},
+}
+
+var osPatterns = []struct {
+	Name    string
+	Pattern *regexp.Regexp
+}{
+	{"Windows Phone", regexp.MustCompile(`Windows Phone(?: OS)? ([\d.]+)`)},
+	{"Windows", regexp.MustCompile(`Windows NT ([\d.]+)`)},
+	{"iOS", regexp.MustCompile(`(?:iPhone|iPad|iPod).*? OS ([\d_]+)`)},
+	{"macOS", regexp.MustCompile(`Mac OS X ([\d_.]+)`)},
+	{"Android", regexp.MustCompile(`Android ([\d.]+)`)},
+	{"Chrome OS", regexp.MustCompile(`CrOS \S+ ([\d.]+)`)},
+	{"Linux", regexp.MustCompile(`Linux()`)},
+}
+
+// Marketing names of Windows NT versions
+var windowsVersions = map[string]string{
+	"5.1":  "XP",
+	"6.0":  "Vista",
+	"6.1":  "7",
+	"6.2":  "8",
+	"6.3":  "8.1",
+	"10.0": "10",
+}
+
+var (
+	botPattern    = regexp.MustCompile(`(?i)bot|crawler|spider|crawling|headless|lighthouse|slurp`)
+	tabletPattern = regexp.MustCompile(`iPad|Tablet|Kindle|Silk|PlayBook`)
+	mobilePattern = regexp.MustCompile(`Mobi|iPhone|iPod|Android|Windows Phone|BlackBerry|Opera Mini`)
+)
+
+// parseUserAgent extracts the browser, OS and device type from a User-Agent
+// header. Unknown parts are left empty.
+func parseUserAgent(ua string) *models.Client {
+	client := &models.Client{}
+	if ua == "" {
+		return client
+	}
+
+	for _, bp := range browserPatterns {
+		if match := bp.Pattern.FindStringSubmatch(ua); match != nil {
+			client.Browser = bp.Name
+			client.BrowserVersion = majorMinor(match[1])
+			break
+		}
+	}
+
+	for _, op := range osPatterns {
+		if match := op.Pattern.FindStringSubmatch(ua); match != nil {
+			client.OS = op.Name
+			client.OSVersion = strings.Replace(match[1], "_", ".", -1)
+			if op.Name == "Windows" {
+				if name, ok := windowsVersions[client.OSVersion]; ok {
+					client.OSVersion = name
+				}
+			}
+			break
+		}
+	}
+
+	switch {
+	case botPattern.MatchString(ua):
+		client.Device = "bot"
+	// Android tablets are the ones not marked as mobile
+	case tabletPattern.MatchString(ua), strings.Contains(ua, "Android") && !strings.Contains(ua, "Mobile"):
+		client.Device = "tablet"
+	case mobilePattern.MatchString(ua):
+		client.Device = "mobile"
+	default:
+		client.Device = "desktop"
+	}
+
+	return client
+}
+
+// majorMinor shortens a version to its first two components.
+func majorMinor(version string) string {
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) > 2 {
+		parts = parts[:2]
+	}
+
+	return strings.Join(parts, ".")
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/lavab/goji/web"
+
+	"github.com/lavab/lavatrace/models"
+)
+
+// Report schemas by version, built from the limits once the flags are parsed
+var reportSchemas map[int]map[string]interface{}
+
+// validationError lists everything that's wrong with a report.
+type validationError struct {
+	Errors []*SchemaError
+}
+
+func (e *validationError) Error() string {
+	messages := []string{}
+	for _, err := range e.Errors {
+		messages = append(messages, err.Path+": "+err.Message)
+	}
+
+	return "Invalid report: " + strings.Join(messages, ", ")
+}
+
+const stacktracePattern = `^$|^(?:\d+|/|native):-?\d+:-?\d+(?:;(?:\d+|/|native):-?\d+:-?\d+)*$`
+
+// Schema of the short context strings (tags, user fields)
+var shortString = map[string]interface{}{
+	"type":      "string",
+	"maxLength": 200,
+}
+
+// buildReportSchemas generates the published JSON Schemas of the report
+// formats. v1 is the original format with string stacktraces, v2 uses
+// structured frames.
+func buildReportSchemas() map[int]map[string]interface{} {
+	schemas := map[int]map[string]interface{}{}
+
+	for _, version := range []int{1, 2} {
+		entry := map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": false,
+			"required":             []interface{}{"message"},
+			"properties": map[string]interface{}{
+				"date": map[string]interface{}{
+					"type":        "integer",
+					"minimum":     0,
+					"description": "JS timestamp in milliseconds",
+				},
+				"type": map[string]interface{}{
+					"type":        "string",
+					"maxLength":   32,
+					"description": "Console method or error kind, eg. log, warn, error",
+				},
+				"message": map[string]interface{}{
+					"type":      "string",
+					"maxLength": *maxMessageLength,
+				},
+				"objects": map[string]interface{}{
+					"type":     []interface{}{"array", "null"},
+					"maxItems": *maxObjects,
+				},
+				"cause": map[string]interface{}{
+					"$ref": "#/definitions/entry",
+				},
+				"errors": map[string]interface{}{
+					"type":     "array",
+					"maxItems": *maxEntries,
+					"items": map[string]interface{}{
+						"$ref": "#/definitions/entry",
+					},
+				},
+			},
+		}
+		definitions := map[string]interface{}{
+			"entry": entry,
+		}
+
+		entryProperties := entry["properties"].(map[string]interface{})
+		if version == 1 {
+			entryProperties["stacktrace"] = map[string]interface{}{
+				"type":        "string",
+				"pattern":     stacktracePattern,
+				"description": "Semicolon-separated assetIndex:line:column calls, / and native instead of the index for unknown and native code",
+			}
+		} else {
+			entryProperties["frames"] = map[string]interface{}{
+				"type":     "array",
+				"maxItems": *maxFrames,
+				"items": map[string]interface{}{
+					"$ref": "#/definitions/frame",
+				},
+			}
+			definitions["frame"] = map[string]interface{}{
+				"type":                 "object",
+				"additionalProperties": false,
+				"required":             []interface{}{"line", "column"},
+				"properties": map[string]interface{}{
+					"asset": map[string]interface{}{
+						"type":        []interface{}{"integer", "null"},
+						"minimum":     0,
+						"description": "Index in assets, null for unknown sources",
+					},
+					"native": map[string]interface{}{
+						"type": "boolean",
+					},
+					"line": map[string]interface{}{
+						"type":    "integer",
+						"minimum": 0,
+					},
+					"column": map[string]interface{}{
+						"type":    "integer",
+						"minimum": 0,
+					},
+				},
+			}
+		}
+
+		schemas[version] = map[string]interface{}{
+			"$schema":              "http://json-schema.org/draft-04/schema#",
+			"id":                   "/schema/" + strconv.Itoa(version),
+			"title":                "lavatrace report v" + strconv.Itoa(version),
+			"type":                 "object",
+			"additionalProperties": false,
+			"required":             []interface{}{"commitID", "entries"},
+			"properties": map[string]interface{}{
+				"schema": map[string]interface{}{
+					"enum": []interface{}{version},
+				},
+				"commitID": map[string]interface{}{
+					"type":      "string",
+					"minLength": 1,
+					"maxLength": 128,
+				},
+				"version": map[string]interface{}{
+					"type":      "string",
+					"maxLength": 128,
+				},
+				"reportID": map[string]interface{}{
+					"type":        "string",
+					"minLength":   1,
+					"maxLength":   128,
+					"description": "Client-generated ID, retries with the same ID return the original event ID",
+				},
+				"assets": map[string]interface{}{
+					"type":     "array",
+					"maxItems": *maxAssets,
+					"items": map[string]interface{}{
+						"type":      "string",
+						"maxLength": 2048,
+					},
+				},
+				"entries": map[string]interface{}{
+					"type":     "array",
+					"minItems": 1,
+					"maxItems": *maxEntries,
+					"items": map[string]interface{}{
+						"$ref": "#/definitions/entry",
+					},
+				},
+				"url": map[string]interface{}{
+					"type":        "string",
+					"maxLength":   2048,
+					"description": "URL of the page the report was sent from",
+				},
+				"user": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": false,
+					"properties": map[string]interface{}{
+						"id":         shortString,
+						"username":   shortString,
+						"email":      shortString,
+						"ip_address": shortString,
+					},
+				},
+				"tags": map[string]interface{}{
+					"type":                 "object",
+					"additionalProperties": shortString,
+				},
+				"extra": map[string]interface{}{
+					"type": "object",
+				},
+				"environment": shortString,
+				"channel": map[string]interface{}{
+					"type":        "string",
+					"maxLength":   200,
+					"description": "Release channel, eg. stable or beta",
+				},
+			},
+			"definitions": definitions,
+		}
+	}
+
+	return schemas
+}
+
+// decodeReport reads, validates and decodes a report of any schema version.
+// v2 reports are converted so that the rest of the pipeline only has to deal
+// with v1 stacktraces.
+func decodeReport(w http.ResponseWriter, req *http.Request) (*models.Report, error) {
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, req.Body, int64(*maxReportSize)))
+	if err != nil {
+		return nil, &httpError{
+			Code:    413,
+			Message: "Report too large",
+		}
+	}
+
+	return parseReport(body)
+}
+
+// parseReport validates and decodes the body of a report.
+func parseReport(body []byte) (*models.Report, error) {
+	// Decode into generic values first to validate the report
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&raw); err != nil {
+		return nil, badRequest(err.Error())
+	}
+
+	object, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, &validationError{[]*SchemaError{{
+			Path:    "/",
+			Message: "expected object, got " + jsonType(raw),
+		}}}
+	}
+
+	version := 1
+	if value, ok := object["schema"].(json.Number); ok {
+		x, err := value.Int64()
+		if err == nil {
+			version = int(x)
+		}
+	}
+	schema, ok := reportSchemas[version]
+	if !ok {
+		return nil, &validationError{[]*SchemaError{{
+			Path:    "/schema",
+			Message: "unsupported schema version",
+		}}}
+	}
+
+	if errors := validateSchema(schema, raw); len(errors) > 0 {
+		return nil, &validationError{errors}
+	}
+
+	var report *models.Report
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, badRequest(err.Error())
+	}
+	if report.Schema == 0 {
+		report.Schema = 1
+	}
+
+	// Checks that can't be expressed in the schema
+	errors := []*SchemaError{}
+	for i, entry := range report.Entries {
+		errors = append(errors, checkEntry(report, entry, "/entries/"+strconv.Itoa(i), 0)...)
+	}
+	if len(errors) > 0 {
+		return nil, &validationError{errors}
+	}
+
+	return report, nil
+}
+
+// checkEntry enforces the nesting, frame and object size limits and converts
+// v2 frames into a stacktrace.
+func checkEntry(report *models.Report, entry *models.Entry, path string, depth int) []*SchemaError {
+	if depth > maxCauseDepth {
+		return []*SchemaError{{
+			Path:    path,
+			Message: "must be nested at most " + strconv.Itoa(maxCauseDepth) + " levels deep",
+		}}
+	}
+
+	errors := []*SchemaError{}
+
+	if report.Schema == 2 {
+		parts := []string{}
+		for i, frame := range entry.Frames {
+			switch {
+			case frame.Native:
+				parts = append(parts, "native")
+			case frame.Asset == nil:
+				parts = append(parts, "/")
+			case *frame.Asset >= len(report.Assets):
+				errors = append(errors, &SchemaError{
+					Path:    path + "/frames/" + strconv.Itoa(i) + "/asset",
+					Message: "refers to a missing asset",
+				})
+				continue
+			default:
+				parts = append(parts, strconv.Itoa(*frame.Asset))
+			}
+
+			parts[len(parts)-1] += ":" + strconv.Itoa(frame.Line) + ":" + strconv.Itoa(frame.Column)
+		}
+
+		entry.Stacktrace = strings.Join(parts, ";")
+	} else if entry.Stacktrace != "" {
+		calls := strings.Split(entry.Stacktrace, ";")
+		if len(calls) > *maxFrames {
+			errors = append(errors, &SchemaError{
+				Path:    path + "/stacktrace",
+				Message: "must contain at most " + strconv.Itoa(*maxFrames) + " frames",
+			})
+		}
+
+		for i, call := range calls {
+			index, err := strconv.Atoi(call[:strings.Index(call, ":")])
+			if err == nil && index >= len(report.Assets) {
+				errors = append(errors, &SchemaError{
+					Path:    path + "/stacktrace",
+					Message: "frame " + strconv.Itoa(i) + " refers to a missing asset",
+				})
+			}
+		}
+	}
+
+	if entry.Objects != nil {
+		data, _ := json.Marshal(entry.Objects)
+		if len(data) > *maxObjectSize {
+			errors = append(errors, &SchemaError{
+				Path:    path + "/objects",
+				Message: "must be at most " + strconv.Itoa(*maxObjectSize) + " bytes long",
+			})
+		}
+	}
+
+	if entry.Cause != nil {
+		errors = append(errors, checkEntry(report, entry.Cause, path+"/cause", depth+1)...)
+	}
+	for i, inner := range entry.Errors {
+		errors = append(errors, checkEntry(report, inner, path+"/errors/"+strconv.Itoa(i), depth+1)...)
+	}
+
+	return errors
+}
+
+// GET /schema - lists the supported report schema versions
+func listSchemas(w http.ResponseWriter, req *http.Request) {
+	writeJSON(w, map[string]interface{}{
+		"versions": []int{1, 2},
+		"current":  2,
+	})
+}
+
+// GET /schema/:version - the JSON Schema of a report version
+func showSchema(c web.C, w http.ResponseWriter, req *http.Request) {
+	version, err := strconv.Atoi(strings.TrimPrefix(c.URLParams["version"], "v"))
+	if err != nil {
+		w.WriteHeader(404)
+		w.Write([]byte("Schema not found"))
+		return
+	}
+
+	schema, ok := reportSchemas[version]
+	if !ok {
+		w.WriteHeader(404)
+		w.Write([]byte("Schema not found"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/schema+json")
+	json.NewEncoder(w).Encode(schema)
+}
@@ -0,0 +1,31 @@
+package models
+
+import (
+	"time"
+)
+
+// Activity types
+const (
+	ActivityResolved       = "resolved"
+	ActivityIgnored        = "ignored"
+	ActivityUnresolved     = "unresolved"
+	ActivityRegressed      = "regressed"
+	ActivityAssigned       = "assigned"
+	ActivityUnassigned     = "unassigned"
+	ActivityCommented      = "commented"
+	ActivityCommentDeleted = "comment_deleted"
+	ActivityLinked         = "linked"
+	ActivityUnlinked       = "unlinked"
+	ActivityMerged         = "merged"
+	ActivityUnmerged       = "unmerged"
+)
+
+// Activity is a single entry of an issue's history.
+type Activity struct {
+	ID      string                 `json:"id" gorethink:"id"`
+	IssueID string                 `json:"issue_id" gorethink:"issue_id"`
+	Type    string                 `json:"type" gorethink:"type"`
+	Actor   string                 `json:"actor" gorethink:"actor"`
+	Date    time.Time              `json:"date" gorethink:"date"`
+	Data    map[string]interface{} `json:"data,omitempty" gorethink:"data,omitempty"`
+}
@@ -0,0 +1,17 @@
+package models
+
+// Breadcrumbs is the Sentry interface for the events leading to an error.
+type Breadcrumbs struct {
+	Values []*Breadcrumb `json:"values"`
+}
+
+func (b *Breadcrumbs) Class() string { return "breadcrumbs" }
+
+type Breadcrumb struct {
+	Timestamp float64                `json:"timestamp"`
+	Type      string                 `json:"type,omitempty"`
+	Category  string                 `json:"category,omitempty"`
+	Level     string                 `json:"level,omitempty"`
+	Message   string                 `json:"message,omitempty"`
+	Data      map[string]interface{} `json:"data,omitempty"`
+}
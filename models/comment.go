@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+// Comment is a note left on an issue.
+type Comment struct {
+	ID      string    `json:"id" gorethink:"id"`
+	IssueID string    `json:"issue_id" gorethink:"issue_id"`
+	Author  string    `json:"author" gorethink:"author"`
+	Body    string    `json:"body" gorethink:"body"`
+	Date    time.Time `json:"date" gorethink:"date"`
+}
+
+// Link points an issue to an external ticket.
+type Link struct {
+	ID      string    `json:"id" gorethink:"id"`
+	IssueID string    `json:"issue_id" gorethink:"issue_id"`
+	URL     string    `json:"url" gorethink:"url"`
+	Title   string    `json:"title,omitempty" gorethink:"title,omitempty"`
+	Author  string    `json:"author" gorethink:"author"`
+	Date    time.Time `json:"date" gorethink:"date"`
+}
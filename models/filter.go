@@ -0,0 +1,28 @@
+package models
+
+import (
+	"time"
+)
+
+// Inbound filter types
+const (
+	FilterBrowserExtension = "browser_extension"
+	FilterCrawler          = "crawler"
+	FilterLegacyBrowser    = "legacy_browser"
+	FilterScriptError      = "script_error"
+	FilterMessage          = "message"
+	FilterURL              = "url"
+	FilterUserAgent        = "user_agent"
+)
+
+// Filter drops matching reports before they're processed. Pattern is a
+// regexp for the message, url and user_agent filters and a list of minimal
+// versions, eg. "Internet Explorer<11", for legacy_browser.
+type Filter struct {
+	ID          string    `json:"id" gorethink:"id"`
+	Type        string    `json:"type" gorethink:"type"`
+	Pattern     string    `json:"pattern,omitempty" gorethink:"pattern,omitempty"`
+	Description string    `json:"description,omitempty" gorethink:"description,omitempty"`
+	Enabled     bool      `json:"enabled" gorethink:"enabled"`
+	Date        time.Time `json:"date" gorethink:"date"`
+}
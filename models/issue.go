@@ -0,0 +1,61 @@
+package models
+
+import (
+	"time"
+)
+
+// Issue statuses
+const (
+	IssueUnresolved = "unresolved"
+	IssueResolved   = "resolved"
+	IssueIgnored    = "ignored"
+	IssueRegressed  = "regressed"
+)
+
+// Issue groups all reports sharing a fingerprint.
+type Issue struct {
+	ID          string    `json:"id" gorethink:"id"`
+	Fingerprint string    `json:"fingerprint" gorethink:"fingerprint"`
+	Message     string    `json:"message" gorethink:"message"`
+	Culprit     string    `json:"culprit" gorethink:"culprit"`
+	Count       int       `json:"count" gorethink:"count"`
+	FirstSeen   time.Time `json:"first_seen" gorethink:"first_seen"`
+	LastSeen    time.Time `json:"last_seen" gorethink:"last_seen"`
+	FirstCommit string    `json:"first_commit" gorethink:"first_commit"`
+	LastCommit  string    `json:"last_commit" gorethink:"last_commit"`
+	LastVersion string    `json:"last_version" gorethink:"last_version"`
+
+	// Events included in Count that were sampled out or rate limited, and so
+	// neither stored nor sent to Sentry
+	Dropped int `json:"dropped" gorethink:"dropped"`
+
+	// Dropped events by fingerprint, so that they follow their fingerprint
+	// on unmerges
+	DroppedFingerprints map[string]int `json:"dropped_fingerprints,omitempty" gorethink:"dropped_fingerprints,omitempty"`
+
+	// All fingerprints grouped into this issue, including the ones of the
+	// issues that were merged into it
+	Fingerprints []string `json:"fingerprints" gorethink:"fingerprints"`
+
+	// In-app frames of the latest event, used to find similar issues
+	Frames []string `json:"frames" gorethink:"frames"`
+
+	Status     string `json:"status" gorethink:"status"`
+	AssignedTo string `json:"assigned_to,omitempty" gorethink:"assigned_to,omitempty"`
+
+	// Resolution - if both are empty, any new event regresses the issue,
+	// otherwise only events from a newer version or another commit do.
+	ResolvedAt      time.Time `json:"resolved_at" gorethink:"resolved_at"`
+	ResolvedVersion string    `json:"resolved_version,omitempty" gorethink:"resolved_version,omitempty"`
+	ResolvedCommit  string    `json:"resolved_commit,omitempty" gorethink:"resolved_commit,omitempty"`
+
+	// Ignore conditions - an issue with neither of them set is ignored forever
+	IgnoreCount int       `json:"ignore_count,omitempty" gorethink:"ignore_count,omitempty"`
+	IgnoreBase  int       `json:"ignore_base,omitempty" gorethink:"ignore_base,omitempty"`
+	IgnoreUntil time.Time `json:"ignore_until" gorethink:"ignore_until"`
+}
+
+// Open returns whether the issue currently needs attention.
+func (i *Issue) Open() bool {
+	return i.Status == IssueUnresolved || i.Status == IssueRegressed
+}
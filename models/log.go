@@ -15,6 +15,13 @@ type LogEntry struct {
 	Message string      `json:"message"`
 	Objects interface{} `json:"objects"`
 	Frames  []*LogFrame `json:"frames"`
+
+	// Message as sent by the client, if it had to be rewritten
+	OriginalMessage string `json:"original_message,omitempty"`
+
+	// Symbolicated Error.cause and AggregateError.errors
+	Cause  *LogEntry   `json:"cause,omitempty"`
+	Errors []*LogEntry `json:"errors,omitempty"`
 }
 
 type LogFrame struct {
@@ -28,4 +35,7 @@ type LogFrame struct {
 	ContextPost []string `json:"context_post,omitempty"`
 	AbsPath     string   `json:"abs_path"`
 	StartLineNo int      `json:"start_line_no"`
+
+	// Whether the frame is used to compute the fingerprint
+	Group bool `json:"-"`
 }
@@ -1,17 +1,88 @@
 package models
 
+import (
+	"time"
+)
+
 type Report struct {
-	ID       string   `json:"-"`
-	CommitID string   `json:"commitID"`
-	Version  string   `json:"version"`
-	Assets   []string `json:"assets"`
-	Entries  []*Entry `json:"entries"`
+	ID       string   `json:"-" gorethink:"id"`
+	Schema   int      `json:"schema,omitempty" gorethink:"schema"`
+	CommitID string   `json:"commitID" gorethink:"commit_id"`
+	Version  string   `json:"version" gorethink:"version"`
+	Assets   []string `json:"assets" gorethink:"assets"`
+	Entries  []*Entry `json:"entries" gorethink:"entries"`
+
+	// Client-generated ID used to recognize retried submissions
+	ReportID string `json:"reportID,omitempty" gorethink:"report_id,omitempty"`
+
+	// Client context
+	URL         string                 `json:"url,omitempty" gorethink:"url,omitempty"`
+	User        *User                  `json:"user,omitempty" gorethink:"user,omitempty"`
+	Tags        map[string]string      `json:"tags,omitempty" gorethink:"tags,omitempty"`
+	Extra       map[string]interface{} `json:"extra,omitempty" gorethink:"extra,omitempty"`
+	Environment string                 `json:"environment,omitempty" gorethink:"environment,omitempty"`
+	Channel     string                 `json:"channel,omitempty" gorethink:"channel,omitempty"`
+
+	// Parsed from the request's headers
+	UserAgent string  `json:"-" gorethink:"user_agent,omitempty"`
+	Client    *Client `json:"-" gorethink:"client,omitempty"`
+
+	// Set by the API once the report has been grouped
+	IssueID     string    `json:"-" gorethink:"issue_id"`
+	Fingerprint string    `json:"-" gorethink:"fingerprint"`
+	ReceivedAt  time.Time `json:"-" gorethink:"received_at"`
+
+	// Identical reports received within the dedupe window
+	Repeats int `json:"-" gorethink:"repeats,omitempty"`
+
+	// Number of values redacted by each PII detector
+	Scrubbed map[string]int `json:"-" gorethink:"scrubbed,omitempty"`
 }
 
 type Entry struct {
-	Date       int64         `json:"date"`
-	Stacktrace string        `json:"stacktrace"`
-	Type       string        `json:"type"`
-	Message    string        `json:"message"`
-	Objects    []interface{} `json:"objects"`
+	Date       int64         `json:"date" gorethink:"date"`
+	Stacktrace string        `json:"stacktrace" gorethink:"stacktrace"`
+	Frames     []*Frame      `json:"frames,omitempty" gorethink:"frames,omitempty"`
+	Type       string        `json:"type" gorethink:"type"`
+	Message    string        `json:"message" gorethink:"message"`
+	Objects    []interface{} `json:"objects" gorethink:"objects"`
+
+	// Error.cause and AggregateError.errors, each with their own stacktrace
+	Cause  *Entry   `json:"cause,omitempty" gorethink:"cause,omitempty"`
+	Errors []*Entry `json:"errors,omitempty" gorethink:"errors,omitempty"`
+}
+
+// ReportKey maps the client-generated ID of a report to its event ID, even
+// if the report was dropped, so that retries aren't counted again.
+type ReportKey struct {
+	ID      string    `json:"id" gorethink:"id"`
+	EventID string    `json:"event_id" gorethink:"event_id"`
+	Date    time.Time `json:"date" gorethink:"date"`
+}
+
+// Frame is a structured stack frame of v2 reports.
+type Frame struct {
+	Asset  *int `json:"asset" gorethink:"asset"`
+	Native bool `json:"native,omitempty" gorethink:"native,omitempty"`
+	Line   int  `json:"line" gorethink:"line"`
+	Column int  `json:"column" gorethink:"column"`
+}
+
+// User is the Sentry interface describing the user affected by an error.
+type User struct {
+	ID        string `json:"id,omitempty" gorethink:"id,omitempty"`
+	Username  string `json:"username,omitempty" gorethink:"username,omitempty"`
+	Email     string `json:"email,omitempty" gorethink:"email,omitempty"`
+	IPAddress string `json:"ip_address,omitempty" gorethink:"ip_address,omitempty"`
+}
+
+func (u *User) Class() string { return "user" }
+
+// Client describes the browser that sent a report.
+type Client struct {
+	Browser        string `json:"browser" gorethink:"browser"`
+	BrowserVersion string `json:"browser_version" gorethink:"browser_version"`
+	OS             string `json:"os" gorethink:"os"`
+	OSVersion      string `json:"os_version" gorethink:"os_version"`
+	Device         string `json:"device" gorethink:"device"`
 }